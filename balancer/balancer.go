@@ -0,0 +1,185 @@
+// Package balancer defines the interface of the algorithms which choose
+// a backend for each new connection, and implements the alternatives to
+// Maglev hashing (package maglev):
+//
+//   - rendezvous, or highest random weight, hashing, which moves as few
+//     connections as possible when backends change, at the cost of
+//     hashing every backend on each lookup;
+//   - jump consistent hashing, which needs neither table nor key, but
+//     only moves few connections when the backend with the highest IP
+//     address changes;
+//   - ring hashing with virtual nodes; and
+//   - weighted round-robin, which ignores the hash, for stateless
+//     services such as UDP ones where any backend will do.
+//
+// Like a Maglev table, each balancer identifies backends by ID (see
+// common.Backend.Identity), rejects backends which share an IP
+// address, and does not lock on lookup.
+package balancer
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/maglev"
+)
+
+// A Balancer chooses backends for hashed five-tuples, in proportion to
+// the backends' weights.
+type Balancer interface {
+	// Lookup returns the backend for a hashed five-tuple, or false if
+	// there are no backends.
+	Lookup(key uint64) (*common.Backend, bool)
+
+	// SetWeight sets the weight of a backend, adding it if necessary,
+	// or replacing the backend with the same ID, and removing it if
+	// weight is 0.
+	SetWeight(backend *common.Backend, weight uint) error
+
+	// Update sets the weights of many backends at once, as SetWeight.
+	// If any change fails, none is made.
+	Update(c Config) error
+
+	// Remove removes a backend, unless it has been replaced by another
+	// with the same ID.
+	Remove(backend *common.Backend)
+
+	// Backends returns the backends, ordered by IP address.
+	Backends() []*common.Backend
+
+	// SetKey changes the key used to hash backends.
+	SetKey(key common.Key)
+}
+
+// A Config is a mapping from backends to weights.
+type Config = maglev.Config
+
+var _ Balancer = (*maglev.Table)(nil)
+
+type member struct {
+	backend *common.Backend
+	weight  uint
+}
+
+// A set is the backends of a balancer.  Each change calls build with
+// the backends, ordered by IP address, and the key.
+type set struct {
+	build func(members []member, key common.Key)
+
+	mutex   sync.Mutex
+	key     common.Key
+	members map[string]member // keyed by ID
+}
+
+func newSet(key common.Key, build func([]member, common.Key)) set {
+	return set{build: build, key: key, members: make(map[string]member)}
+}
+
+// rebuild calls build.  s.mutex must be held.
+func (s *set) rebuild() {
+	members := make([]member, 0, len(s.members))
+	for _, m := range s.members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return bytes.Compare(members[i].backend.IP, members[j].backend.IP) < 0
+	})
+	s.build(members, s.key)
+}
+
+func (s *set) SetKey(key common.Key) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.key = key
+	s.rebuild()
+}
+
+func (s *set) SetWeight(backend *common.Backend, weight uint) error {
+	if backend == nil {
+		panic("backend is nil")
+	}
+	return s.Update(Config{backend: weight})
+}
+
+func (s *set) Update(c Config) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	members := make(map[string]member, len(s.members)+len(c))
+	for id, m := range s.members {
+		members[id] = m
+	}
+	seen := make(map[string]bool, len(c))
+	for b, w := range c {
+		if b == nil {
+			panic("nil backend in config")
+		}
+		id := b.Identity()
+		if seen[id] {
+			return fmt.Errorf("duplicate backend %q", id)
+		}
+		seen[id] = true
+		if w == 0 {
+			delete(members, id)
+		}
+	}
+	for b, w := range c {
+		if w == 0 {
+			continue
+		}
+		id := b.Identity()
+		if w > common.MaxWeight {
+			return fmt.Errorf("backend %q has weight %d, more than %d",
+				id, w, common.MaxWeight)
+		}
+		for other, m := range members {
+			if other != id && bytes.Equal(m.backend.IP, b.IP) {
+				return fmt.Errorf("backends %q and %q have the same IP "+
+					"address", other, id)
+			}
+		}
+		members[id] = member{b, w}
+	}
+	s.members = members
+	s.rebuild()
+	return nil
+}
+
+func (s *set) Remove(backend *common.Backend) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if backend == nil {
+		return
+	}
+	id := backend.Identity()
+	if m, ok := s.members[id]; ok && m.backend == backend {
+		delete(s.members, id)
+		s.rebuild()
+	}
+}
+
+func (s *set) Backends() []*common.Backend {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	backends := make([]*common.Backend, 0, len(s.members))
+	for _, m := range s.members {
+		backends = append(backends, m.backend)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return bytes.Compare(backends[i].IP, backends[j].IP) < 0
+	})
+	return backends
+}
+
+// mix scrambles the bits of x (the SplitMix64 finalizer).
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,153 @@
+package balancer
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/maglev"
+)
+
+var balancers = map[string]func() Balancer{
+	"maglev":     func() Balancer { return maglev.New(maglev.SmallM) },
+	"rendezvous": func() Balancer { return NewRendezvous(maglev.DefaultKey) },
+	"jump":       func() Balancer { return NewJump() },
+	"ring":       func() Balancer { return NewRing(maglev.DefaultKey) },
+	"roundrobin": func() Balancer { return NewRoundRobin() },
+}
+
+func testBackends(n int) []*common.Backend {
+	backends := make([]*common.Backend, n)
+	for i := range backends {
+		backends[i] = &common.Backend{IP: []byte{10, 0, 0, byte(i + 1)}}
+	}
+	return backends
+}
+
+func TestEmpty(t *testing.T) {
+	for name, newBalancer := range balancers {
+		b := newBalancer()
+		_, ok := b.Lookup(1)
+		assert.False(t, ok, "%s: lookup succeeded with no backends", name)
+
+		backend := testBackends(1)[0]
+		require.NoError(t, b.SetWeight(backend, 1))
+		got, ok := b.Lookup(1)
+		assert.True(t, ok, name)
+		assert.Same(t, backend, got, name)
+		b.Remove(backend)
+		_, ok = b.Lookup(1)
+		assert.False(t, ok, "%s: lookup succeeded with no backends", name)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	const lookups = 60000
+	backends := testBackends(3)
+	for name, newBalancer := range balancers {
+		b := newBalancer()
+		require.NoError(t, b.Update(Config{backends[0]: 1, backends[1]: 2,
+			backends[2]: 3}))
+		assert.Equal(t, backends, b.Backends(), name)
+
+		r := rand.New(rand.NewSource(42))
+		freq := make(map[*common.Backend]int)
+		for i := 0; i < lookups; i++ {
+			got, ok := b.Lookup(r.Uint64())
+			require.True(t, ok, name)
+			freq[got]++
+		}
+		for i, backend := range backends {
+			assert.InEpsilon(t, lookups*(i+1)/6, freq[backend], 0.1,
+				"%s: backend %d has the wrong share", name, i)
+		}
+	}
+}
+
+// TestConsistency checks that balancers with the same backends choose
+// the same backend for each key, however they were built.
+func TestConsistency(t *testing.T) {
+	for name, newBalancer := range balancers {
+		if name == "roundrobin" {
+			continue
+		}
+		backends := testBackends(20)
+		a := newBalancer()
+		for _, backend := range backends {
+			a.SetWeight(backend, 1)
+		}
+		b := newBalancer()
+		for _, i := range rand.Perm(len(backends)) {
+			b.SetWeight(&common.Backend{IP: backends[i].IP}, 1)
+		}
+		for key := uint64(0); key < 1000; key++ {
+			x, _ := a.Lookup(key * 0x9e3779b97f4a7c15)
+			y, _ := b.Lookup(key * 0x9e3779b97f4a7c15)
+			require.Equal(t, x.IP, y.IP, "%s: key %d", name, key)
+		}
+	}
+}
+
+// TestMinimalDisruption checks that removing a backend only moves the
+// connections which went to it, for the balancers which promise so.
+func TestMinimalDisruption(t *testing.T) {
+	for _, name := range []string{"rendezvous", "ring", "jump"} {
+		backends := testBackends(10)
+		b := balancers[name]()
+		for _, backend := range backends {
+			b.SetWeight(backend, 1)
+		}
+		before := make(map[uint64]*common.Backend)
+		for key := uint64(0); key < 10000; key++ {
+			before[key], _ = b.Lookup(mix(key))
+		}
+
+		// jump only promises so for the last backend
+		removed := backends[len(backends)-1]
+		b.Remove(removed)
+		moved := 0
+		for key, was := range before {
+			now, _ := b.Lookup(mix(key))
+			require.NotSame(t, removed, now, name)
+			if now != was {
+				require.Same(t, removed, was,
+					"%s: key %d moved from a remaining backend", name, key)
+				moved++
+			}
+		}
+		assert.NotZero(t, moved, name)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	for name, newBalancer := range balancers {
+		b := newBalancer()
+		a := &common.Backend{IP: []byte{10, 0, 0, 1}, ID: "a"}
+		require.NoError(t, b.SetWeight(a, 1))
+
+		// a new Backend with the same ID replaces the old one
+		a2 := &common.Backend{IP: []byte{10, 0, 0, 1}, ID: "a"}
+		require.NoError(t, b.SetWeight(a2, 1))
+		assert.Equal(t, []*common.Backend{a2}, b.Backends(), name)
+		b.Remove(a)
+		assert.Len(t, b.Backends(), 1, "%s: stale removal", name)
+
+		// weights are bounded
+		heavy := &common.Backend{IP: []byte{10, 0, 0, 9}}
+		assert.Error(t, b.SetWeight(heavy, common.MaxWeight+1), name)
+		assert.Error(t, b.Update(Config{heavy: common.MaxWeight + 1}), name)
+		assert.NotContains(t, b.Backends(), heavy, name)
+
+		// one with the same IP address and a different ID is rejected
+		c := &common.Backend{IP: []byte{10, 0, 0, 1}, ID: "c"}
+		assert.Error(t, b.SetWeight(c, 1), name)
+		assert.Error(t, b.Update(Config{c: 1, a2: 1}), name)
+		assert.NoError(t, b.Update(Config{c: 1, a2: 0}), name)
+		assert.Equal(t, []*common.Backend{c}, b.Backends(), name)
+
+		assert.Panics(t, func() { b.SetWeight(nil, 1) }, name)
+	}
+}
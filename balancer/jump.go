@@ -0,0 +1,58 @@
+package balancer
+
+import (
+	"sync/atomic"
+
+	"github.com/sipb/spike/common"
+)
+
+// Jump is a jump consistent hashing balancer (Lamping and Veach,
+// https://arxiv.org/abs/1406.2294).  It needs no table, but its buckets
+// are numbered, here in order of IP address with as many buckets per
+// backend as its weight, and only changes at the end of the order move
+// as few connections as possible.  Adding or removing any other backend
+// moves the connections of every backend after it too.
+type Jump struct {
+	set
+	buckets atomic.Pointer[[]*common.Backend]
+}
+
+// NewJump returns an empty jump consistent hashing balancer.  Backends
+// are not hashed, so it has no key of its own.
+func NewJump() *Jump {
+	j := &Jump{}
+	j.set = newSet(common.Key{}, j.build)
+	return j
+}
+
+func (j *Jump) build(members []member, _ common.Key) {
+	var buckets []*common.Backend
+	for _, m := range members {
+		for i := uint(0); i < m.weight; i++ {
+			buckets = append(buckets, m.backend)
+		}
+	}
+	j.buckets.Store(&buckets)
+}
+
+// Lookup returns the backend for a hashed five-tuple, or false if there
+// are no backends.
+func (j *Jump) Lookup(key uint64) (*common.Backend, bool) {
+	buckets := j.buckets.Load()
+	if buckets == nil || len(*buckets) == 0 {
+		return nil, false
+	}
+	return (*buckets)[jump(key, len(*buckets))], true
+}
+
+// jump returns the bucket of key among n buckets.
+func jump(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) /
+			float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,63 @@
+package balancer
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/sipb/spike/common"
+)
+
+// Rendezvous is a weighted rendezvous (highest random weight) hashing
+// balancer.  Each backend scores every five-tuple, and the highest
+// score wins, so a change to one backend only moves connections to or
+// from it.  Lookups take time proportional to the number of backends.
+type Rendezvous struct {
+	set
+	nodes atomic.Pointer[[]rendezvousNode]
+}
+
+type rendezvousNode struct {
+	backend *common.Backend
+	seed    uint64
+	weight  float64
+}
+
+// NewRendezvous returns an empty rendezvous hashing balancer which
+// hashes backends with the given key.
+func NewRendezvous(key common.Key) *Rendezvous {
+	r := &Rendezvous{}
+	r.set = newSet(key, r.build)
+	return r
+}
+
+func (r *Rendezvous) build(members []member, key common.Key) {
+	nodes := make([]rendezvousNode, len(members))
+	for i, m := range members {
+		nodes[i] = rendezvousNode{
+			backend: m.backend,
+			seed:    key.Hash(m.backend.IP),
+			weight:  float64(m.weight),
+		}
+	}
+	r.nodes.Store(&nodes)
+}
+
+// Lookup returns the backend for a hashed five-tuple, or false if there
+// are no backends.
+func (r *Rendezvous) Lookup(key uint64) (*common.Backend, bool) {
+	nodes := r.nodes.Load()
+	if nodes == nil || len(*nodes) == 0 {
+		return nil, false
+	}
+	var best *common.Backend
+	bestScore := -1.0
+	for _, n := range *nodes {
+		// a uniform number in (0, 1), from which the score is drawn
+		// so that each backend wins in proportion to its weight
+		u := (float64(mix(n.seed^key)>>11) + 0.5) / (1 << 53)
+		if score := n.weight / -math.Log(u); score > bestScore {
+			best, bestScore = n.backend, score
+		}
+	}
+	return best, true
+}
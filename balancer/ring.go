@@ -0,0 +1,70 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync/atomic"
+
+	"github.com/sipb/spike/common"
+)
+
+// RingReplicas is the number of points on the ring of each unit of a
+// backend's weight.
+const RingReplicas = 100
+
+// Ring is a ring hashing balancer with virtual nodes.  Each backend has
+// RingReplicas points on a ring per unit of weight, placed by hashing
+// its IP address, and a five-tuple goes to the backend of the first
+// point at or after its hash.
+type Ring struct {
+	set
+	points atomic.Pointer[[]ringPoint]
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *common.Backend
+}
+
+// NewRing returns an empty ring hashing balancer which hashes backends
+// with the given key.
+func NewRing(key common.Key) *Ring {
+	r := &Ring{}
+	r.set = newSet(key, r.build)
+	return r
+}
+
+func (r *Ring) build(members []member, key common.Key) {
+	var points []ringPoint
+	for _, m := range members {
+		buf := make([]byte, len(m.backend.IP), len(m.backend.IP)+4)
+		copy(buf, m.backend.IP)
+		for i := uint(0); i < m.weight*RingReplicas; i++ {
+			buf = binary.BigEndian.AppendUint32(buf[:len(m.backend.IP)],
+				uint32(i))
+			points = append(points, ringPoint{key.Hash(buf), m.backend})
+		}
+	}
+	// members are in order of IP address, so a stable sort breaks
+	// ties between points consistently
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	r.points.Store(&points)
+}
+
+// Lookup returns the backend for a hashed five-tuple, or false if there
+// are no backends.
+func (r *Ring) Lookup(key uint64) (*common.Backend, bool) {
+	points := r.points.Load()
+	if points == nil || len(*points) == 0 {
+		return nil, false
+	}
+	i := sort.Search(len(*points), func(i int) bool {
+		return (*points)[i].hash >= key
+	})
+	if i == len(*points) {
+		i = 0
+	}
+	return (*points)[i].backend, true
+}
@@ -0,0 +1,60 @@
+package balancer
+
+import (
+	"sync/atomic"
+
+	"github.com/sipb/spike/common"
+)
+
+// RoundRobin is a smooth weighted round-robin balancer, for stateless
+// services where any backend will do.  It ignores the hash, sending
+// each lookup to the next backend in turn, with backends taking turns
+// in proportion to their weights and as evenly spread as possible.
+// Connection tracking still keeps the packets of a flow together.
+type RoundRobin struct {
+	set
+	order atomic.Pointer[[]*common.Backend]
+	next  atomic.Uint64
+}
+
+// NewRoundRobin returns an empty weighted round-robin balancer.
+// Backends are not hashed, so it has no key of its own.
+func NewRoundRobin() *RoundRobin {
+	r := &RoundRobin{}
+	r.set = newSet(common.Key{}, r.build)
+	return r
+}
+
+// build computes one round, as nginx does: each turn, every backend's
+// credit grows by its weight, and the backend with the most credit is
+// chosen and pays for it with the total weight.
+func (r *RoundRobin) build(members []member, _ common.Key) {
+	var total int
+	for _, m := range members {
+		total += int(m.weight)
+	}
+	credit := make([]int, len(members))
+	order := make([]*common.Backend, 0, total)
+	for len(order) < total {
+		best := 0
+		for i, m := range members {
+			credit[i] += int(m.weight)
+			if credit[i] > credit[best] {
+				best = i
+			}
+		}
+		credit[best] -= total
+		order = append(order, members[best].backend)
+	}
+	r.order.Store(&order)
+}
+
+// Lookup returns the next backend, or false if there are no backends.
+// The key is ignored.
+func (r *RoundRobin) Lookup(uint64) (*common.Backend, bool) {
+	order := r.order.Load()
+	if order == nil || len(*order) == 0 {
+		return nil, false
+	}
+	return (*order)[(r.next.Add(1)-1)%uint64(len(*order))], true
+}
@@ -0,0 +1,25 @@
+package balancer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sipb/spike/common"
+)
+
+func TestRoundRobinOrder(t *testing.T) {
+	backends := testBackends(3)
+	r := NewRoundRobin()
+	r.Update(Config{backends[0]: 5, backends[1]: 1, backends[2]: 1})
+
+	var order []*common.Backend
+	for i := 0; i < 14; i++ {
+		b, _ := r.Lookup(0)
+		order = append(order, b)
+	}
+	a, b, c := backends[0], backends[1], backends[2]
+	round := []*common.Backend{a, a, b, a, c, a, a}
+	assert.Equal(t, append(round, round...), order,
+		"turns are not smoothly interleaved")
+}
@@ -1,10 +1,30 @@
 package common
 
+import "net"
+
+// MaxWeight is the largest weight of a backend.  Some balancers use
+// memory in proportion to their backends' weights, so weights are
+// bounded.
+const MaxWeight = 1 << 16
+
 // Backend keeps track of a backend's IP address and whether the backend
 // has become unhealthy.
 type Backend struct {
 	IP []byte
 
+	// ID identifies the backend across health flaps, when a new Backend
+	// is made for it each time it comes up, for example its address.
+	// It may be empty.
+	ID string
+
 	// Unhealthy is closed when the backend is determined to be unhealthy.
 	Unhealthy chan struct{}
 }
+
+// Identity returns the backend's ID, or its IP address if it has none.
+func (b *Backend) Identity() string {
+	if b.ID != "" {
+		return b.ID
+	}
+	return net.IP(b.IP).String()
+}
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dchest/siphash"
+)
+
+// A Key is a 128-bit siphash key.  Keys should be kept secret, since
+// anyone who knows the key can craft flows that hash to the same
+// backend.
+type Key struct {
+	K0, K1 uint64
+}
+
+// DefaultLookupKey is the key used by FiveTuple.Hash.  It is public,
+// so production deployments should configure their own key.
+var DefaultLookupKey = Key{0xdd5d635024f19f34, 0}
+
+var errInvalidKey = errors.New("key is not 32 hex digits")
+
+// NewKey generates a random key.
+func NewKey() (Key, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return Key{}, err
+	}
+	return Key{
+		K0: binary.BigEndian.Uint64(b[0:8]),
+		K1: binary.BigEndian.Uint64(b[8:16]),
+	}, nil
+}
+
+// ParseKey parses a key written as 32 hexadecimal digits, as returned
+// by String.
+func ParseKey(s string) (Key, error) {
+	if len(s) != 32 {
+		return Key{}, errInvalidKey
+	}
+	k0, err := strconv.ParseUint(s[:16], 16, 64)
+	if err != nil {
+		return Key{}, errInvalidKey
+	}
+	k1, err := strconv.ParseUint(s[16:], 16, 64)
+	if err != nil {
+		return Key{}, errInvalidKey
+	}
+	return Key{k0, k1}, nil
+}
+
+// String returns the key as 32 hexadecimal digits.
+func (k Key) String() string {
+	return fmt.Sprintf("%016x%016x", k.K0, k.K1)
+}
+
+// Hash returns the 64-bit siphash of p under the key.
+func (k Key) Hash(p []byte) uint64 {
+	return siphash.Hash(k.K0, k.K1, p)
+}
+
+// Hash128 returns the 128-bit siphash of p under the key.
+func (k Key) Hash128(p []byte) (uint64, uint64) {
+	return siphash.Hash128(k.K0, k.K1, p)
+}
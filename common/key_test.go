@@ -0,0 +1,30 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKey(t *testing.T) {
+	key, err := NewKey()
+	require.NoError(t, err)
+	parsed, err := ParseKey(key.String())
+	require.NoError(t, err)
+	assert.Equal(t, key, parsed)
+
+	parsed, err = ParseKey("dd5d635024f19f340000000000000000")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultLookupKey, parsed)
+
+	for _, s := range []string{
+		"",
+		"dd5d635024f19f34",
+		"dd5d635024f19f34000000000000000g",
+		"+d5d635024f19f340000000000000000",
+	} {
+		_, err := ParseKey(s)
+		assert.Error(t, err, "%q parsed", s)
+	}
+}
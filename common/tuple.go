@@ -1,23 +1,137 @@
 package common
 
 import (
-	"github.com/dchest/siphash"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
 )
 
-const lookupKey = uint64(0xdd5d635024f19f34)
+// Lengths of the binary encoding of IPv4 and IPv6 five-tuples.
+const (
+	IPv4FiveTupleLen = 14
+	IPv6FiveTupleLen = 38
+)
 
 // A FiveTuple consists of source and destination IP and port, along
-// with the IP protocol version number.
+// with the IP protocol number.
+//
+// Src and Dst are either both IPv4 or both IPv6 addresses.  Fragments
+// are identified by their three-tuple, with both ports set to zero.
 type FiveTuple struct {
-	data []byte // TODO split this into fields
+	Protocol uint8
+	Src      netip.Addr
+	Dst      netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+// NewFiveTuple constructs a new five-tuple from the fields of a parsed
+// packet.
+func NewFiveTuple(protocol uint8,
+	src netip.Addr, srcPort uint16,
+	dst netip.Addr, dstPort uint16) FiveTuple {
+	return FiveTuple{
+		Protocol: protocol,
+		Src:      src,
+		Dst:      dst,
+		SrcPort:  srcPort,
+		DstPort:  dstPort,
+	}
+}
+
+// FiveTupleFromBytes decodes a five-tuple from its binary encoding, as
+// produced by Bytes and by five_tuple.lua.
+func FiveTupleFromBytes(data []byte) (FiveTuple, error) {
+	var t FiveTuple
+	var n int
+	switch len(data) {
+	case IPv4FiveTupleLen:
+		n = 4
+	case IPv6FiveTupleLen:
+		n = 16
+	default:
+		return t, fmt.Errorf("five-tuple has bad length %d", len(data))
+	}
+	protocol := binary.LittleEndian.Uint16(data[0:2])
+	if protocol > 0xff {
+		return t, fmt.Errorf("five-tuple has bad protocol %d", protocol)
+	}
+	t.Protocol = uint8(protocol)
+	t.SrcPort = binary.LittleEndian.Uint16(data[2:4])
+	t.DstPort = binary.LittleEndian.Uint16(data[4:6])
+	t.Src, _ = netip.AddrFromSlice(data[6 : 6+n])
+	t.Dst, _ = netip.AddrFromSlice(data[6+n : 6+2*n])
+	return t, nil
+}
+
+// Bytes returns the canonical binary encoding of the five-tuple, which
+// is what Hash hashes.  The encoding is the protocol, source port and
+// destination port as little-endian 16-bit integers, followed by the
+// source and destination addresses; it is 14 bytes long for IPv4 and
+// 38 bytes long for IPv6.
+func (t FiveTuple) Bytes() []byte {
+	src := t.Src.AsSlice()
+	dst := t.Dst.AsSlice()
+	data := make([]byte, 6, 6+len(src)+len(dst))
+	binary.LittleEndian.PutUint16(data[0:2], uint16(t.Protocol))
+	binary.LittleEndian.PutUint16(data[2:4], t.SrcPort)
+	binary.LittleEndian.PutUint16(data[4:6], t.DstPort)
+	data = append(data, src...)
+	return append(data, dst...)
+}
+
+// String returns the five-tuple in the form
+// "src/srcport/dst/dstport/protocol", which ParseFiveTuple accepts.
+func (t FiveTuple) String() string {
+	return fmt.Sprintf("%v/%d/%v/%d/%d",
+		t.Src, t.SrcPort, t.Dst, t.DstPort, t.Protocol)
+}
+
+// ParseFiveTuple parses a five-tuple in the form returned by String.
+func ParseFiveTuple(s string) (FiveTuple, error) {
+	var t FiveTuple
+	fields := strings.Split(s, "/")
+	if len(fields) != 5 {
+		return t, fmt.Errorf("five-tuple %q does not have 5 fields", s)
+	}
+	src, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return t, err
+	}
+	dst, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return t, err
+	}
+	if src.Is4() != dst.Is4() {
+		return t, errors.New("five-tuple mixes IPv4 and IPv6 addresses")
+	}
+	srcPort, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return t, err
+	}
+	dstPort, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return t, err
+	}
+	protocol, err := strconv.ParseUint(fields[4], 10, 8)
+	if err != nil {
+		return t, err
+	}
+	return NewFiveTuple(uint8(protocol),
+		src, uint16(srcPort), dst, uint16(dstPort)), nil
 }
 
-// NewFiveTuple constructs a new five-tuple.
-func NewFiveTuple(data []byte) *FiveTuple {
-	return &FiveTuple{data: data}
+// Hash returns the five-tuple hash under DefaultLookupKey.
+func (t FiveTuple) Hash() uint64 {
+	return t.HashWithKey(DefaultLookupKey)
 }
 
-// Hash returns the five-tuple hash.
-func (p *FiveTuple) Hash() uint64 {
-	return siphash.Hash(lookupKey, 0, p.data)
+// HashWithKey returns the five-tuple hash under the given key.  Every
+// spike must hash with the same key for flows to reach the same backend
+// regardless of which spike they arrive at.
+func (t FiveTuple) HashWithKey(k Key) uint64 {
+	return k.Hash(t.Bytes())
 }
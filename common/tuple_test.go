@@ -0,0 +1,62 @@
+package common
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFiveTupleBytes(t *testing.T) {
+	// As produced by five_tuple(L3_IPV4, L4_TCP, 1.0.0.0, 12345,
+	// 18.0.0.0, 80) in five_tuple.lua.
+	lua := []byte{
+		6, 0, 0x39, 0x30, 80, 0,
+		1, 0, 0, 0,
+		18, 0, 0, 0,
+	}
+	tuple, err := FiveTupleFromBytes(lua)
+	require.NoError(t, err)
+	assert.Equal(t, NewFiveTuple(6,
+		netip.MustParseAddr("1.0.0.0"), 12345,
+		netip.MustParseAddr("18.0.0.0"), 80), tuple)
+	assert.Equal(t, lua, tuple.Bytes())
+
+	v6 := NewFiveTuple(17,
+		netip.MustParseAddr("2001:db8::1"), 53,
+		netip.MustParseAddr("::ffff:18.0.0.0"), 5353)
+	data := v6.Bytes()
+	assert.Len(t, data, IPv6FiveTupleLen)
+	decoded, err := FiveTupleFromBytes(data)
+	require.NoError(t, err)
+	assert.Equal(t, v6, decoded)
+	assert.Equal(t, v6.Hash(), decoded.Hash())
+
+	_, err = FiveTupleFromBytes(lua[:13])
+	assert.Error(t, err, "bad length accepted")
+	_, err = FiveTupleFromBytes(append([]byte{0x00, 0x08}, lua[2:]...))
+	assert.Error(t, err, "ethertype accepted as protocol")
+}
+
+func TestParseFiveTuple(t *testing.T) {
+	for _, s := range []string{
+		"19.168.124.100/572/81.9.179.69/80/4",
+		"2001:db8::1/50270/2001:db8::2/80/6",
+	} {
+		tuple, err := ParseFiveTuple(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, s, tuple.String())
+	}
+
+	for _, s := range []string{
+		"19.168.124.100/572/81.9.179.69/80",
+		"19.168.124.100/572/2001:db8::2/80/6",
+		"19.168.124.100/65536/81.9.179.69/80/6",
+		"19.168.124.100/572/81.9.179.69/80/256",
+		"19.168.124/572/81.9.179.69/80/6",
+	} {
+		_, err := ParseFiveTuple(s)
+		assert.Error(t, err, "%v parsed", s)
+	}
+}
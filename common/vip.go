@@ -0,0 +1,56 @@
+package common
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+)
+
+// IP protocol numbers of the transport protocols spike balances.
+const (
+	ProtocolTCP = 6
+	ProtocolUDP = 17
+)
+
+var protocolNames = map[uint8]string{
+	ProtocolTCP: "tcp",
+	ProtocolUDP: "udp",
+}
+
+// ParseProtocol parses a transport protocol name, "tcp" or "udp".
+func ParseProtocol(s string) (uint8, error) {
+	for p, name := range protocolNames {
+		if s == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown protocol %q", s)
+}
+
+// ProtocolName returns the name of a transport protocol, or its number
+// if it has no name.
+func ProtocolName(p uint8) string {
+	if name, ok := protocolNames[p]; ok {
+		return name
+	}
+	return strconv.Itoa(int(p))
+}
+
+// A VIP identifies a virtual service by destination address, protocol
+// and port.  A Port of zero matches any port.
+type VIP struct {
+	Addr     netip.Addr
+	Protocol uint8
+	Port     uint16
+}
+
+// String returns the VIP in the form "18.0.0.1:80/tcp".
+func (v VIP) String() string {
+	return fmt.Sprintf("%v/%s",
+		netip.AddrPortFrom(v.Addr, v.Port), ProtocolName(v.Protocol))
+}
+
+// VIP returns the VIP which the five-tuple is addressed to.
+func (t FiveTuple) VIP() VIP {
+	return VIP{Addr: t.Dst, Protocol: t.Protocol, Port: t.DstPort}
+}
@@ -3,35 +3,688 @@ package config
 // Read configuration stuff from a yaml file.
 
 import (
-	"gopkg.in/yaml.v2"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/health"
+)
+
+// Health check types.
+const (
+	HealthCheckNone = "none"
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"  // the address is host:port
+	HealthCheckGRPC = "grpc" // the address is host:port
+	HealthCheckUDP  = "udp"  // the address is host:port
+	HealthCheckDNS  = "dns"  // the address is host:port
+)
+
+var healthChecks = map[string]bool{
+	HealthCheckNone: true,
+	HealthCheckHTTP: true,
+	HealthCheckTCP:  true,
+	HealthCheckGRPC: true,
+	HealthCheckUDP:  true,
+	HealthCheckDNS:  true,
+}
+
+// Balancers, which choose a service's backend for each new connection.
+const (
+	BalancerMaglev     = "maglev"
+	BalancerRendezvous = "rendezvous"
+	BalancerJump       = "jump"
+	BalancerRing       = "ring"
+	BalancerRoundRobin = "roundrobin"
 )
 
+var balancers = map[string]bool{
+	"":                 true, // Maglev
+	BalancerMaglev:     true,
+	BalancerRendezvous: true,
+	BalancerJump:       true,
+	BalancerRing:       true,
+	BalancerRoundRobin: true,
+}
+
 type Backend struct {
 	Address     string
-	IP          []byte
+	IP          IP
 	HealthCheck string
+
+	// Weight is the backend's share of new connections relative to the
+	// other backends of its service, at most common.MaxWeight.  It
+	// defaults to 1; a backend with weight 0 is health checked but
+	// receives no new connections.
+	Weight uint
+
+	Health Health
+}
+
+// Health configures how a backend is health checked.  Zero means the
+// default.
+type Health struct {
+	Interval time.Duration // between checks
+	Timeout  time.Duration // for each check
+
+	// Rise and Fall are how many consecutive checks must succeed for
+	// the backend to come up, and fail for it to go down.
+	Rise int
+	Fall int
+
+	// Jitter is the fraction of the interval by which each interval is
+	// randomly lengthened or shortened, so that backends are not all
+	// checked at once.
+	Jitter float64
+
+	// MaxInterval is the longest interval between checks of a backend
+	// which is down: each failure doubles the interval up to it.  The
+	// interval does not grow by default.
+	MaxInterval time.Duration
+
+	HTTP HTTPHealth
+	GRPC GRPCHealth
+	UDP  UDPHealth
+	DNS  DNSHealth
+}
+
+// GRPCHealth configures a grpc health check, which calls
+// grpc.health.v1.Health/Check at the backend's address.
+type GRPCHealth struct {
+	Service string // the service to check, or "" for the whole server
+
+	// TLS connects with TLS.  CA and SkipVerify are as for http checks,
+	// and need TLS.
+	TLS        bool
+	CA         string
+	SkipVerify bool
+}
+
+// TLSConfig returns the TLS configuration of grpc health checks, or nil
+// if they do not use TLS.
+func (h GRPCHealth) TLSConfig() (*tls.Config, error) {
+	if !h.TLS {
+		return nil, nil
+	}
+	return tlsConfig(h.CA, h.SkipVerify)
+}
+
+// UDPHealth configures a udp health check, which sends a request
+// datagram to the backend's address and expects a response.
+type UDPHealth struct {
+	Request string
+
+	// Response is a regular expression which the response must match;
+	// by default any response will do.
+	Response string
+}
+
+// DNSHealth configures a dns health check, which queries the backend's
+// address over UDP.
+type DNSHealth struct {
+	Name string // required
+	Type string // A by default
+
+	// RCodes are the names of the response codes of a healthy
+	// response, such as NXDOMAIN; by default, only NOERROR.
+	RCodes []string
+}
+
+// HTTPHealth configures an http health check, which fetches the
+// backend's address.  Zero means the default.
+type HTTPHealth struct {
+	Method  string            // GET by default
+	Host    string            // the Host header, if not the address's host
+	Headers map[string]string // other request headers
+
+	// Status are the status codes of a healthy response; by default,
+	// any 2xx code.
+	Status []int
+
+	// Body is a regular expression which the body must match; by
+	// default the word "healthy".  MaxBody is how many bytes of the
+	// body are read, by default 64 KiB.
+	Body    string
+	MaxBody int64
+
+	// CA is a file of PEM certificates of the authorities trusted to
+	// sign the certificates of https addresses, instead of the
+	// system's.  SkipVerify disables verifying them at all.
+	CA         string
+	SkipVerify bool
+}
+
+// TLSConfig returns the TLS configuration of https health checks, or nil
+// for the default.
+func (h HTTPHealth) TLSConfig() (*tls.Config, error) {
+	if h.CA == "" && !h.SkipVerify {
+		return nil, nil
+	}
+	return tlsConfig(h.CA, h.SkipVerify)
+}
+
+// tlsConfig returns a TLS configuration trusting the certificates in the
+// PEM file ca, or the system's if it is "", and not verifying them at
+// all if skipVerify.
+func tlsConfig(ca string, skipVerify bool) (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: skipVerify}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", ca)
+		}
+	}
+	return c, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (b *Backend) UnmarshalYAML(n *yaml.Node) error {
+	type plain Backend
+	p := plain{Weight: 1}
+	if err := n.Decode(&p); err != nil {
+		return err
+	}
+	*b = Backend(p)
+	return nil
+}
+
+// An IP is a backend IP address, in the 4- or 16-byte form expected by
+// common.Backend.  In YAML it is written either as a textual address
+// (10.0.0.7 or 2001:db8::7) or as a list of bytes ([10, 0, 0, 7]).
+type IP []byte
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (ip *IP) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.SequenceNode {
+		var b []byte
+		if err := n.Decode(&b); err != nil {
+			return err
+		}
+		*ip = b
+		return nil
+	}
+	var s string
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf(
+			"line %d: %q is not an IP address", n.Line, s)}}
+	}
+	*ip = addr.AsSlice()
+	return nil
+}
+
+// A Service is a virtual service, identified by its VIP, protocol and
+// port, with its own pool of backends.
+type Service struct {
+	VIP      IP
+	Protocol string // "tcp" or "udp"
+	Port     uint16 // 0 matches any port
+	Balancer string // empty for Maglev
+	Backends []Backend
+}
+
+// Timeouts are how long connections are tracked without seeing a
+// packet, depending on their state.  Zero means the default.
+type Timeouts struct {
+	TCPSyn         time.Duration // SYN seen, but no further packets
+	TCPEstablished time.Duration
+	TCPClosing     time.Duration // FIN or RST seen
+	UDP            time.Duration
+}
+
+// Sync configures sharing tracked connections with other spikes.
+type Sync struct {
+	Listen   string   // UDP address to listen on; empty to disable
+	Peers    []string // UDP addresses of the other spikes
+	Interval time.Duration
+
+	// Key authenticates sync datagrams, written as 32 hex digits.  It
+	// is required to sync, and every spike must use the same key.
+	Key string
+}
+
+// Snapshot configures saving backends and tracked connections to a
+// file, so that they survive a restart.
+type Snapshot struct {
+	File     string // empty to disable
+	Interval time.Duration
 }
 
 type T struct {
-	Backends    []Backend
+	Services []Service
+
+	// Backends are the backends of the default service, which serves
+	// traffic to destinations not matching any of Services.
+	Backends []Backend
+
 	SrcMac      string
 	DstMac      string
 	IPv4Address string
+	IPv6Address string
 	Incap       string
 	Outcap      string
+
+	// LookupKey and MaglevKey are the siphash keys, written as 32 hex
+	// digits, used to hash five-tuples and backend IPs respectively.
+	// Every spike in a fleet must use the same keys.  If they are
+	// unset, public default keys are used.
+	LookupKey string
+	MaglevKey string
+
+	// Timeouts are written as durations such as "30s" or "15m".
+	Timeouts Timeouts
+
+	Sync     Sync
+	Snapshot Snapshot
 }
 
-func Read(file string) T {
+// An Error is a problem with a configuration file.
+type Error struct {
+	File string
+	Line int // 0 if the problem is not with a particular line
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// An ErrorList is a list of every problem found in a configuration
+// file.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Load reads and validates a configuration file.  If the file is
+// invalid, the error is an ErrorList describing every problem.
+func Load(file string) (T, error) {
 	var config T
 	dat, err := ioutil.ReadFile(file)
 	if err != nil {
-		log.Fatal("Cannot read config file: %v", file)
+		return config, ErrorList{{File: file, Msg: err.Error()}}
 	}
-	err = yaml.Unmarshal(dat, &config)
+	return parse(file, dat)
+}
+
+// Read is like Load, but exits on error.
+func Read(file string) T {
+	config, err := Load(file)
 	if err != nil {
-		log.Fatal("Cannot unmarshal config yaml: %v", err)
+		log.Fatalf("Cannot load config:\n%v", err)
 	}
 	return config
 }
+
+func parse(file string, dat []byte) (T, error) {
+	var config T
+	v := &validator{file: file}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(dat, &doc); err != nil {
+		v.errs = append(v.errs, &Error{File: file, Msg: err.Error()})
+		return config, v.errs
+	}
+	if len(doc.Content) == 0 {
+		v.errorf(&doc, "empty configuration")
+		return config, v.errs
+	}
+	root := doc.Content[0]
+	if err := root.Decode(&config); err != nil {
+		if terr, ok := err.(*yaml.TypeError); ok {
+			for _, msg := range terr.Errors {
+				e := &Error{File: file, Msg: msg}
+				// yaml reports errors as "line N: message"
+				if _, err := fmt.Sscanf(msg, "line %d:", &e.Line); err == nil {
+					_, e.Msg, _ = strings.Cut(msg, ": ")
+				}
+				v.errs = append(v.errs, e)
+			}
+		} else {
+			v.errorf(root, "%v", err)
+		}
+		return config, v.errs
+	}
+
+	v.validate(&config, root)
+	if len(v.errs) > 0 {
+		return config, v.errs
+	}
+	return config, nil
+}
+
+type validator struct {
+	file string
+	errs ErrorList
+}
+
+func (v *validator) errorf(n *yaml.Node, format string, args ...interface{}) {
+	v.errs = append(v.errs, &Error{
+		File: v.file,
+		Line: n.Line,
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// field returns the value of the given key in a mapping node, or the
+// mapping node itself if the key is not present, so that errors about
+// missing keys point at the enclosing mapping.
+func field(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == key {
+				return n.Content[i+1]
+			}
+		}
+	}
+	return n
+}
+
+func (v *validator) validate(config *T, root *yaml.Node) {
+	if config.SrcMac != "" {
+		v.checkMAC(config.SrcMac, field(root, "srcmac"), "srcmac")
+	}
+	if config.DstMac == "" {
+		v.errorf(root, "dstmac is required")
+	} else {
+		v.checkMAC(config.DstMac, field(root, "dstmac"), "dstmac")
+	}
+	if config.IPv4Address != "" {
+		if ip := net.ParseIP(config.IPv4Address); ip == nil || ip.To4() == nil {
+			v.errorf(field(root, "ipv4address"),
+				"ipv4address %q is not an IPv4 address",
+				config.IPv4Address)
+		}
+	}
+	if config.IPv6Address != "" {
+		if ip := net.ParseIP(config.IPv6Address); ip == nil || ip.To4() != nil {
+			v.errorf(field(root, "ipv6address"),
+				"ipv6address %q is not an IPv6 address",
+				config.IPv6Address)
+		}
+	}
+	v.checkKey(config.LookupKey, field(root, "lookupkey"), "lookupkey")
+	v.checkKey(config.MaglevKey, field(root, "maglevkey"), "maglevkey")
+
+	timeoutsNode := field(root, "timeouts")
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"tcpsyn", config.Timeouts.TCPSyn},
+		{"tcpestablished", config.Timeouts.TCPEstablished},
+		{"tcpclosing", config.Timeouts.TCPClosing},
+		{"udp", config.Timeouts.UDP},
+	} {
+		if t.d < 0 {
+			v.errorf(field(timeoutsNode, t.name),
+				"timeout %s is negative", t.name)
+		}
+	}
+
+	syncNode := field(root, "sync")
+	if config.Sync.Listen != "" {
+		v.checkHostPort(config.Sync.Listen, field(syncNode, "listen"),
+			"sync listen")
+		if config.Sync.Key == "" {
+			v.errorf(syncNode, "sync key is required")
+		}
+	} else if len(config.Sync.Peers) > 0 {
+		v.errorf(syncNode, "sync peers require sync listen")
+	}
+	for i, p := range config.Sync.Peers {
+		v.checkHostPort(p, element(field(syncNode, "peers"), i),
+			"sync peer")
+	}
+	v.checkKey(config.Sync.Key, field(syncNode, "key"), "sync key")
+	if config.Sync.Interval < 0 {
+		v.errorf(field(syncNode, "interval"), "sync interval is negative")
+	}
+	if config.Snapshot.Interval < 0 {
+		v.errorf(field(field(root, "snapshot"), "interval"),
+			"snapshot interval is negative")
+	}
+
+	v.checkBackends(config, config.Backends, field(root, "backends"))
+
+	servicesNode := field(root, "services")
+	vips := make(map[common.VIP]int)
+	for i, svc := range config.Services {
+		n := element(servicesNode, i)
+
+		var vip common.VIP
+		if addr, ok := netip.AddrFromSlice(svc.VIP); ok {
+			vip.Addr = addr
+		} else if len(svc.VIP) == 0 {
+			v.errorf(n, "service vip is required")
+		} else {
+			v.errorf(field(n, "vip"), "service vip has length %d, "+
+				"not 4 or 16", len(svc.VIP))
+		}
+		if protocol, err := common.ParseProtocol(svc.Protocol); err == nil {
+			vip.Protocol = protocol
+		} else {
+			v.errorf(field(n, "protocol"), "service protocol %q is not "+
+				"tcp or udp", svc.Protocol)
+		}
+		vip.Port = svc.Port
+		if line, ok := vips[vip]; ok {
+			v.errorf(n, "duplicate service %v (first on line %d)",
+				vip, line)
+		} else {
+			vips[vip] = n.Line
+		}
+
+		if !balancers[svc.Balancer] {
+			v.errorf(field(n, "balancer"), "unknown balancer %q",
+				svc.Balancer)
+		}
+		if len(svc.Backends) == 0 {
+			v.errorf(n, "service %v has no backends", vip)
+		}
+		v.checkBackends(config, svc.Backends, field(n, "backends"))
+	}
+}
+
+// element returns the i'th element of a sequence node.
+func element(n *yaml.Node, i int) *yaml.Node {
+	if n.Kind == yaml.SequenceNode && i < len(n.Content) {
+		return n.Content[i]
+	}
+	return n
+}
+
+// checkBackends validates the backends of one service.
+func (v *validator) checkBackends(config *T, backends []Backend,
+	backendsNode *yaml.Node) {
+	addresses := make(map[string]int)
+	ips := make(map[string]int)
+	for i, b := range backends {
+		n := element(backendsNode, i)
+
+		if b.Address == "" {
+			v.errorf(n, "backend address is required")
+		} else if line, ok := addresses[b.Address]; ok {
+			v.errorf(field(n, "address"),
+				"duplicate backend address %q (first on line %d)",
+				b.Address, line)
+		} else {
+			addresses[b.Address] = field(n, "address").Line
+		}
+
+		ipNode := field(n, "ip")
+		switch len(b.IP) {
+		case net.IPv4len:
+			if config.IPv4Address == "" {
+				v.errorf(ipNode,
+					"ipv4address is required for IPv4 backend %v",
+					net.IP(b.IP))
+			}
+		case net.IPv6len:
+			if config.IPv6Address == "" {
+				v.errorf(ipNode,
+					"ipv6address is required for IPv6 backend %v",
+					net.IP(b.IP))
+			}
+		case 0:
+			v.errorf(n, "backend ip is required")
+		default:
+			v.errorf(ipNode, "backend ip has length %d, not 4 or 16",
+				len(b.IP))
+		}
+		if len(b.IP) > 0 {
+			key := string(b.IP)
+			if line, ok := ips[key]; ok {
+				v.errorf(ipNode,
+					"duplicate backend ip %v (first on line %d)",
+					net.IP(b.IP), line)
+			} else {
+				ips[key] = ipNode.Line
+			}
+		}
+
+		if b.Weight > common.MaxWeight {
+			v.errorf(field(n, "weight"), "backend weight %d is more than %d",
+				b.Weight, common.MaxWeight)
+		}
+
+		if !healthChecks[b.HealthCheck] {
+			v.errorf(field(n, "healthcheck"),
+				"unknown healthcheck %q", b.HealthCheck)
+		}
+		switch b.HealthCheck {
+		case HealthCheckTCP, HealthCheckGRPC, HealthCheckUDP,
+			HealthCheckDNS:
+			if b.Address != "" {
+				v.checkHostPort(b.Address, field(n, "address"),
+					b.HealthCheck+" backend address")
+			}
+		}
+		v.checkHealth(b.Health, field(n, "health"))
+		if b.HealthCheck == HealthCheckDNS {
+			v.checkDNS(b.Health.DNS, field(field(n, "health"), "dns"))
+		}
+	}
+}
+
+func (v *validator) checkHealth(h Health, n *yaml.Node) {
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"interval", h.Interval},
+		{"timeout", h.Timeout},
+		{"maxinterval", h.MaxInterval},
+	} {
+		if d.d < 0 {
+			v.errorf(field(n, d.name), "health %s is negative", d.name)
+		}
+	}
+	if h.Rise < 0 {
+		v.errorf(field(n, "rise"), "health rise is negative")
+	}
+	if h.Fall < 0 {
+		v.errorf(field(n, "fall"), "health fall is negative")
+	}
+	if h.Jitter < 0 || h.Jitter >= 1 {
+		v.errorf(field(n, "jitter"), "health jitter %v is not in [0, 1)",
+			h.Jitter)
+	}
+
+	httpNode := field(n, "http")
+	if strings.ContainsAny(h.HTTP.Method, " \t\r\n") {
+		v.errorf(field(httpNode, "method"), "http method %q is invalid",
+			h.HTTP.Method)
+	}
+	for _, code := range h.HTTP.Status {
+		if code < 100 || code > 599 {
+			v.errorf(field(httpNode, "status"),
+				"http status %d is not a status code", code)
+		}
+	}
+	if _, err := regexp.Compile(h.HTTP.Body); err != nil {
+		v.errorf(field(httpNode, "body"), "http body: %v", err)
+	}
+	if h.HTTP.MaxBody < 0 {
+		v.errorf(field(httpNode, "maxbody"), "http maxbody is negative")
+	}
+	if _, err := h.HTTP.TLSConfig(); err != nil {
+		v.errorf(field(httpNode, "ca"), "http ca: %v", err)
+	}
+
+	grpcNode := field(n, "grpc")
+	if !h.GRPC.TLS && (h.GRPC.CA != "" || h.GRPC.SkipVerify) {
+		v.errorf(grpcNode, "grpc ca and skipverify need tls")
+	}
+	if _, err := h.GRPC.TLSConfig(); err != nil {
+		v.errorf(field(grpcNode, "ca"), "grpc ca: %v", err)
+	}
+
+	if _, err := regexp.Compile(h.UDP.Response); err != nil {
+		v.errorf(field(field(n, "udp"), "response"), "udp response: %v",
+			err)
+	}
+}
+
+func (v *validator) checkDNS(d DNSHealth, n *yaml.Node) {
+	if d.Name == "" {
+		v.errorf(n, "dns health check has no name")
+	} else if !health.ValidDNSName(d.Name) {
+		v.errorf(field(n, "name"), "dns name %q is invalid", d.Name)
+	}
+	if _, ok := health.DNSTypes[d.Type]; d.Type != "" && !ok {
+		v.errorf(field(n, "type"), "unknown dns type %q", d.Type)
+	}
+	for _, rcode := range d.RCodes {
+		if _, ok := health.DNSRCodes[rcode]; !ok {
+			v.errorf(field(n, "rcodes"), "unknown dns rcode %q", rcode)
+		}
+	}
+}
+
+func (v *validator) checkMAC(mac string, n *yaml.Node, name string) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		v.errorf(n, "%s %q is not a MAC address", name, mac)
+	}
+}
+
+func (v *validator) checkHostPort(addr string, n *yaml.Node, name string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		v.errorf(n, "%s %q is not a host:port address", name, addr)
+	}
+}
+
+func (v *validator) checkKey(key string, n *yaml.Node, name string) {
+	if key == "" {
+		return
+	}
+	if _, err := common.ParseKey(key); err != nil {
+		v.errorf(n, "%s: %v", name, err)
+	}
+}
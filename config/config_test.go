@@ -0,0 +1,529 @@
+package config
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const good = `backends:
+    - address: http://cheesy-fries.mit.edu/health
+      ip: [1, 3, 5, 7]
+      healthcheck: http
+      health:
+          interval: 2s
+          timeout: 500ms
+          rise: 2
+          fall: 3
+          jitter: 0.2
+          maxinterval: 1m
+    - address: http://strawberry-habanero.mit.edu/health
+      ip: [32, 1, 13, 184, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7]
+      healthcheck: none
+    - address: http://ghost-pepper.mit.edu/health
+      ip: 10.0.0.7
+      healthcheck: none
+    - address: http://carolina-reaper.mit.edu/health
+      ip: 2001:db8::8
+      healthcheck: none
+      weight: 3
+srcmac: 11:11:11:11:11:11
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+ipv6address: 2001:db8::1
+lookupkey: 000102030405060708090a0b0c0d0e0f
+timeouts:
+    tcpsyn: 30s
+    udp: 1m
+`
+
+func TestLoadGood(t *testing.T) {
+	cfg, err := parse("good.yaml", []byte(good))
+	require.NoError(t, err)
+	require.Len(t, cfg.Backends, 4)
+	assert.Equal(t, IP{1, 3, 5, 7}, cfg.Backends[0].IP)
+	assert.Equal(t, IP(net.ParseIP("2001:db8::7")), cfg.Backends[1].IP)
+	assert.Equal(t, IP{10, 0, 0, 7}, cfg.Backends[2].IP)
+	assert.Equal(t, IP(net.ParseIP("2001:db8::8")), cfg.Backends[3].IP)
+	assert.Equal(t, uint(1), cfg.Backends[0].Weight)
+	assert.Equal(t, uint(3), cfg.Backends[3].Weight)
+	assert.Equal(t, Health{
+		Interval:    2 * time.Second,
+		Timeout:     500 * time.Millisecond,
+		Rise:        2,
+		Fall:        3,
+		Jitter:      0.2,
+		MaxInterval: time.Minute,
+	}, cfg.Backends[0].Health)
+	assert.Equal(t, Health{}, cfg.Backends[1].Health)
+	assert.Equal(t, "22:22:22:22:22:22", cfg.DstMac)
+	assert.Equal(t, "2001:db8::1", cfg.IPv6Address)
+	assert.Equal(t, Timeouts{TCPSyn: 30 * time.Second, UDP: time.Minute},
+		cfg.Timeouts)
+}
+
+func TestLoadExample(t *testing.T) {
+	_, err := Load("../http.yaml")
+	assert.NoError(t, err)
+}
+
+func TestLoadErrors(t *testing.T) {
+	bad := `backends:
+    - address: http://cheesy-fries.mit.edu/health
+      ip: [1, 3, 5]
+      healthcheck: http
+    - address: http://cheesy-fries.mit.edu/health
+      ip: [2, 4, 6, 8]
+      healthcheck: carrier-pigeon
+    - address: http://strawberry-habanero.mit.edu/health
+      ip: [2, 4, 6, 8]
+      healthcheck: none
+srcmac: 11:11:11:11:11
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5
+maglevkey: xyzzy
+timeouts:
+    udp: -1s
+`
+	_, err := parse("bad.yaml", []byte(bad))
+	require.Error(t, err)
+	list, ok := err.(ErrorList)
+	require.True(t, ok, "error is not an ErrorList")
+
+	lines := make(map[int]string)
+	for _, e := range list {
+		assert.Equal(t, "bad.yaml", e.File)
+		lines[e.Line] = e.Msg
+	}
+	assert.Contains(t, lines[3], "length 3")
+	assert.Contains(t, lines[5], "duplicate backend address")
+	assert.Contains(t, lines[7], "unknown healthcheck")
+	assert.Contains(t, lines[9], "duplicate backend ip")
+	assert.Contains(t, lines[11], "srcmac")
+	assert.Contains(t, lines[13], "ipv4address")
+	assert.Contains(t, lines[14], "maglevkey")
+	assert.Contains(t, lines[16], "udp")
+	assert.Len(t, list, 8)
+
+	_, err = parse("heavy.yaml", []byte(`backends:
+    - address: http://cheesy-fries.mit.edu/health
+      ip: 1.3.5.7
+      healthcheck: none
+      weight: 4000000000
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ":5: backend weight 4000000000 is more than")
+}
+
+func TestLoadIPv6(t *testing.T) {
+	_, err := parse("bad.yaml", []byte(`backends:
+    - address: http://strawberry-habanero.mit.edu/health
+      ip: 2001:db8::7
+      healthcheck: none
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.Error(t, err)
+	list := err.(ErrorList)
+	require.Len(t, list, 1)
+	assert.Equal(t, 3, list[0].Line)
+	assert.Contains(t, list[0].Msg, "ipv6address is required")
+
+	_, err = parse("bad.yaml", []byte(`backends:
+    - address: http://strawberry-habanero.mit.edu/health
+      ip: 2001:db8::7
+      healthcheck: none
+dstmac: 22:22:22:22:22:22
+ipv6address: 1.3.5.7
+`))
+	require.Error(t, err)
+	list = err.(ErrorList)
+	require.Len(t, list, 1)
+	assert.Equal(t, 6, list[0].Line)
+	assert.Contains(t, list[0].Msg, "not an IPv6 address")
+}
+
+func TestLoadTCP(t *testing.T) {
+	cfg, err := parse("tcp.yaml", []byte(`backends:
+    - address: 10.0.0.1:5432
+      ip: 10.0.0.1
+      healthcheck: tcp
+    - address: db.mit.edu
+      ip: 10.0.0.2
+      healthcheck: tcp
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.Error(t, err)
+	list := err.(ErrorList)
+	require.Len(t, list, 1)
+	assert.Equal(t, 5, list[0].Line)
+	assert.Contains(t, list[0].Msg, "not a host:port address")
+
+	cfg, err = parse("tcp.yaml", []byte(`backends:
+    - address: 10.0.0.1:5432
+      ip: 10.0.0.1
+      healthcheck: tcp
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.NoError(t, err)
+	assert.Equal(t, HealthCheckTCP, cfg.Backends[0].HealthCheck)
+}
+
+func TestLoadGRPC(t *testing.T) {
+	_, err := parse("grpc.yaml", []byte(`backends:
+    - address: api.mit.edu
+      ip: 10.0.0.1
+      healthcheck: grpc
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.Error(t, err)
+	list := err.(ErrorList)
+	require.Len(t, list, 1)
+	assert.Equal(t, 2, list[0].Line)
+	assert.Contains(t, list[0].Msg, "grpc backend address")
+
+	cfg, err := parse("grpc.yaml", []byte(`backends:
+    - address: api.mit.edu:50051
+      ip: 10.0.0.1
+      healthcheck: grpc
+      health:
+          grpc:
+              service: spike.Api
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.NoError(t, err)
+	assert.Equal(t, HealthCheckGRPC, cfg.Backends[0].HealthCheck)
+	assert.Equal(t, "spike.Api", cfg.Backends[0].Health.GRPC.Service)
+	tls, err := cfg.Backends[0].Health.GRPC.TLSConfig()
+	require.NoError(t, err)
+	assert.Nil(t, tls)
+
+	cfg, err = parse("grpc.yaml", []byte(`backends:
+    - address: api.mit.edu:50051
+      ip: 10.0.0.1
+      healthcheck: grpc
+      health:
+          grpc:
+              tls: true
+              skipverify: true
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.NoError(t, err)
+	tls, err = cfg.Backends[0].Health.GRPC.TLSConfig()
+	require.NoError(t, err)
+	assert.True(t, tls.InsecureSkipVerify)
+
+	_, err = parse("grpc.yaml", []byte(`backends:
+    - address: api.mit.edu:50051
+      ip: 10.0.0.1
+      healthcheck: grpc
+      health:
+          grpc:
+              skipverify: true
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.Error(t, err)
+	list = err.(ErrorList)
+	require.Len(t, list, 1)
+	assert.Equal(t, 7, list[0].Line)
+	assert.Contains(t, list[0].Msg, "need tls")
+}
+
+func TestLoadUDP(t *testing.T) {
+	_, err := parse("bad.yaml", []byte(`backends:
+    - address: dns.mit.edu
+      ip: 10.0.0.1
+      healthcheck: dns
+    - address: dns.mit.edu:53
+      ip: 10.0.0.2
+      healthcheck: dns
+      health:
+          dns:
+              name: mit..edu
+              type: B
+              rcodes: [NXDOMAIN, NOPE]
+    - address: syslog.mit.edu:514
+      ip: 10.0.0.3
+      healthcheck: udp
+      health:
+          udp:
+              request: ping
+              response: "(pong"
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.Error(t, err)
+	list := err.(ErrorList)
+	require.Len(t, list, 6)
+	assert.Contains(t, list[0].Msg, "dns backend address")
+	assert.Contains(t, list[1].Msg, "no name")
+	assert.Equal(t, 2, list[1].Line)
+	assert.Contains(t, list[2].Msg, `dns name "mit..edu"`)
+	assert.Equal(t, 10, list[2].Line)
+	assert.Contains(t, list[3].Msg, `unknown dns type "B"`)
+	assert.Contains(t, list[4].Msg, `unknown dns rcode "NOPE"`)
+	assert.Contains(t, list[5].Msg, "udp response")
+	assert.Equal(t, 19, list[5].Line)
+
+	cfg, err := parse("good.yaml", []byte(`backends:
+    - address: dns.mit.edu:53
+      ip: 10.0.0.2
+      healthcheck: dns
+      health:
+          dns:
+              name: mit.edu
+              type: AAAA
+              rcodes: [NOERROR, NXDOMAIN]
+    - address: syslog.mit.edu:514
+      ip: 10.0.0.3
+      healthcheck: udp
+      health:
+          udp:
+              request: ping
+              response: ^pong$
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.NoError(t, err)
+	assert.Equal(t, DNSHealth{
+		Name:   "mit.edu",
+		Type:   "AAAA",
+		RCodes: []string{"NOERROR", "NXDOMAIN"},
+	}, cfg.Backends[0].Health.DNS)
+	assert.Equal(t, UDPHealth{Request: "ping", Response: "^pong$"},
+		cfg.Backends[1].Health.UDP)
+}
+
+func TestLoadHealth(t *testing.T) {
+	_, err := parse("bad.yaml", []byte(`backends:
+    - address: a
+      ip: 10.0.0.1
+      healthcheck: none
+      health:
+          interval: -1s
+          rise: -1
+          fall: -2
+          jitter: 1.5
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.Error(t, err)
+	list := err.(ErrorList)
+	require.Len(t, list, 4)
+	assert.Contains(t, list[0].Msg, "interval is negative")
+	assert.Equal(t, 6, list[0].Line)
+	assert.Contains(t, list[1].Msg, "rise is negative")
+	assert.Contains(t, list[2].Msg, "fall is negative")
+	assert.Contains(t, list[3].Msg, "jitter 1.5")
+	assert.Equal(t, 9, list[3].Line)
+}
+
+func TestLoadHTTPHealth(t *testing.T) {
+	_, err := parse("bad.yaml", []byte(`backends:
+    - address: https://cheesy-fries.mit.edu/health
+      ip: 10.0.0.1
+      healthcheck: http
+      health:
+          http:
+              method: GET /
+              status: [200, 99]
+              body: "(unclosed"
+              maxbody: -1
+              ca: /nonexistent/ca.pem
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.Error(t, err)
+	list := err.(ErrorList)
+	require.Len(t, list, 5)
+	assert.Contains(t, list[0].Msg, "method")
+	assert.Equal(t, 7, list[0].Line)
+	assert.Contains(t, list[1].Msg, "status 99")
+	assert.Contains(t, list[2].Msg, "http body")
+	assert.Contains(t, list[3].Msg, "maxbody is negative")
+	assert.Contains(t, list[4].Msg, "http ca")
+	assert.Equal(t, 11, list[4].Line)
+
+	cfg, err := parse("good.yaml", []byte(`backends:
+    - address: https://cheesy-fries.mit.edu/health
+      ip: 10.0.0.1
+      healthcheck: http
+      health:
+          http:
+              method: HEAD
+              host: fries.mit.edu
+              headers:
+                  X-Check: spike
+              status: [200, 204]
+              body: ^ok$
+              maxbody: 1024
+              skipverify: true
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.NoError(t, err)
+	h := cfg.Backends[0].Health.HTTP
+	assert.Equal(t, HTTPHealth{
+		Method:     "HEAD",
+		Host:       "fries.mit.edu",
+		Headers:    map[string]string{"X-Check": "spike"},
+		Status:     []int{200, 204},
+		Body:       "^ok$",
+		MaxBody:    1024,
+		SkipVerify: true,
+	}, h)
+	tls, err := h.TLSConfig()
+	require.NoError(t, err)
+	assert.True(t, tls.InsecureSkipVerify)
+}
+
+func TestLoadTypeErrors(t *testing.T) {
+	_, err := parse("bad.yaml", []byte("backends: 3\ndstmac: [1]\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bad.yaml:1: ")
+
+	_, err = parse("bad.yaml", []byte(`backends:
+    - address: a
+      ip: 10.0.0.256
+    - address: b
+      ip: fe80::1%eth0
+    - address: c
+      ip: [1, 2, 300, 4]
+`))
+	require.Error(t, err)
+	list := err.(ErrorList)
+	require.Len(t, list, 3)
+	assert.Equal(t, 3, list[0].Line)
+	assert.Equal(t, 5, list[1].Line)
+	assert.Equal(t, 7, list[2].Line)
+
+	_, err = parse("bad.yaml", []byte("backends: [\n"))
+	assert.Error(t, err)
+
+	_, err = Load("does-not-exist.yaml")
+	assert.Error(t, err)
+}
+
+func TestLoadServices(t *testing.T) {
+	cfg, err := parse("services.yaml", []byte(`services:
+    - vip: 18.0.0.1
+      protocol: tcp
+      port: 80
+      backends:
+          - address: http://cheesy-fries.mit.edu/health
+            ip: 10.0.0.1
+            healthcheck: http
+    - vip: 18.0.0.1
+      protocol: udp
+      balancer: roundrobin
+      backends:
+          - address: http://cheesy-fries.mit.edu/health
+            ip: 10.0.0.1
+            healthcheck: none
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.NoError(t, err)
+	require.Len(t, cfg.Services, 2)
+	assert.Equal(t, IP{18, 0, 0, 1}, cfg.Services[0].VIP)
+	assert.Equal(t, uint16(80), cfg.Services[0].Port)
+	assert.Equal(t, "udp", cfg.Services[1].Protocol)
+	assert.Equal(t, "", cfg.Services[0].Balancer)
+	assert.Equal(t, BalancerRoundRobin, cfg.Services[1].Balancer)
+	assert.Empty(t, cfg.Backends)
+
+	_, err = parse("bad.yaml", []byte(`services:
+    - vip: 18.0.0.1
+      protocol: tcp
+      port: 80
+      backends:
+          - address: a
+            ip: 10.0.0.1
+            healthcheck: none
+    - vip: 18.0.0.1
+      protocol: tcp
+      port: 80
+      backends:
+          - address: b
+            ip: 10.0.0.2
+            healthcheck: none
+    - vip: 18.0.0.2
+      protocol: sctp
+    - protocol: udp
+      backends:
+          - address: c
+            ip: 10.0.0.3
+            healthcheck: none
+    - vip: 18.0.0.3
+      protocol: tcp
+      balancer: random
+      backends:
+          - address: d
+            ip: 10.0.0.4
+            healthcheck: none
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`))
+	require.Error(t, err)
+	lines := make(map[int]string)
+	for _, e := range err.(ErrorList) {
+		lines[e.Line] = e.Msg
+	}
+	assert.Contains(t, lines[9], "duplicate service")
+	assert.Contains(t, lines[17], "protocol")
+	assert.Contains(t, lines[18], "vip is required")
+	assert.Contains(t, lines[25], "unknown balancer")
+}
+
+func TestLoadSync(t *testing.T) {
+	cfg, err := parse("sync.yaml", []byte(`dstmac: 22:22:22:22:22:22
+sync:
+    listen: ":7000"
+    peers: ["spike2.mit.edu:7000", "[2001:db8::2]:7000"]
+    interval: 10s
+    key: 000102030405060708090a0b0c0d0e0f
+`))
+	require.NoError(t, err)
+	assert.Equal(t, Sync{
+		Listen:   ":7000",
+		Peers:    []string{"spike2.mit.edu:7000", "[2001:db8::2]:7000"},
+		Interval: 10 * time.Second,
+		Key:      "000102030405060708090a0b0c0d0e0f",
+	}, cfg.Sync)
+
+	_, err = parse("bad.yaml", []byte(`dstmac: 22:22:22:22:22:22
+sync:
+    peers: [spike2.mit.edu]
+`))
+	require.Error(t, err)
+	list := err.(ErrorList)
+	require.Len(t, list, 2)
+	assert.Contains(t, list[0].Msg, "require sync listen")
+	assert.Contains(t, list[1].Msg, "host:port")
+	assert.Equal(t, 3, list[1].Line)
+
+	_, err = parse("nokey.yaml", []byte(`dstmac: 22:22:22:22:22:22
+sync:
+    listen: ":7000"
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "sync key is required")
+	_, err = parse("badkey.yaml", []byte(`dstmac: 22:22:22:22:22:22
+sync:
+    listen: ":7000"
+    key: secret
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "sync key")
+}
@@ -4,68 +4,42 @@ import "C"
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sipb/spike/common"
 	"github.com/sipb/spike/config"
-	"github.com/sipb/spike/health"
 	"github.com/sipb/spike/maglev"
-	"github.com/sipb/spike/tracking"
+	"github.com/sipb/spike/pool"
 )
 
-type serviceInfo struct {
-	ip   []byte
-	quit chan<- struct{}
-}
-
-func startChecker(mm *maglev.Table, service string, info *serviceInfo) {
-	quit := make(chan struct{})
-	info.quit = quit
-	backends := make(chan *common.Backend, 1)
-
-	health.CheckFun(func() bool {
-		return health.HTTP(service, 2*time.Second)
-	},
-		func() {
-			log.Printf("backend %v is healthy\n", service)
-			down := make(chan struct{})
-			backend := &common.Backend{
-				IP:        info.ip,
-				Unhealthy: down,
-			}
-			backends <- backend
-			mm.Add(backend)
-		},
-		func() {
-			log.Printf("backend %v is down\n", service)
-			backend := <-backends
-			close(backend.Unhealthy)
-			mm.Remove(backend)
-		},
-		time.Second, 5*time.Second, quit)
-}
-
 func main() {
-	const lookupSizeM = 11
-
-	config := config.Read("http.yaml")
+	cfg := config.Read("http.yaml")
 
-	backends := map[string]*serviceInfo{}
-	for _, bCfg := range config.Backends {
-		backends[bCfg.Address] = &serviceInfo{bCfg.IP, nil}
+	p := pool.New(common.DefaultLookupKey, maglev.DefaultKey)
+	defer p.Close()
+	p.OnHealthChange(func(address string, healthy bool) {
+		if healthy {
+			log.Printf("backend %v is healthy\n", address)
+		} else {
+			log.Printf("backend %v is down\n", address)
+		}
+	})
+	for _, bCfg := range cfg.Backends {
+		p.AddBackend(bCfg)
 	}
 
-	mm := maglev.New(lookupSizeM)
-	tt := tracking.New(mm.Lookup, 10*time.Second)
+	// pools use Maglev hashing unless another balancer is set
+	mm := p.Balancer().(*maglev.Table)
 
-	for service, info := range backends {
-		startChecker(mm, service, info)
-	}
+	// marked is the lookup table when disruption was last reported
+	marked := mm.Slots()
 
 	testPackets := []string{
 		"19.168.124.100/572/81.9.179.69/80/4",
@@ -96,25 +70,29 @@ func main() {
 			fmt.Println("help")
 			fmt.Println("addserver <service> <IP>")
 			fmt.Println("rmserver <service>")
+			fmt.Println("weight <service> <weight>")
+			fmt.Println("drain <service> <seconds>")
+			fmt.Println("flows <service>")
+			fmt.Println("balance")
+			fmt.Println("disruption")
+			fmt.Println("export <file>")
 			fmt.Println("lookup")
 		case "rmserver":
 			if len(words) != 2 {
 				fmt.Println("?")
 				continue
 			}
-			info, ok := backends[words[1]]
-			if !ok {
+			if _, ok := p.Flows(words[1]); !ok {
 				fmt.Println("no such backend")
 				continue
 			}
-			close(info.quit)
-			delete(backends, words[1])
+			p.RemoveBackend(words[1])
 		case "addserver":
 			if len(words) != 3 {
 				fmt.Println("?")
 				continue
 			}
-			if _, ok := backends[words[1]]; ok {
+			if _, ok := p.Flows(words[1]); ok {
 				fmt.Println("backend already exists")
 				continue
 			}
@@ -123,14 +101,81 @@ func main() {
 				fmt.Println("not an IPv4 address")
 				continue
 			}
-			info := &serviceInfo{addr, nil}
-			startChecker(mm, words[1], info)
-			backends[words[1]] = info
+			p.AddBackend(config.Backend{
+				Address:     words[1],
+				IP:          config.IP(addr),
+				HealthCheck: config.HealthCheckHTTP,
+				Weight:      1,
+			})
+		case "weight":
+			if len(words) != 3 {
+				fmt.Println("?")
+				continue
+			}
+			weight, err := strconv.ParseUint(words[2], 10, 0)
+			if err != nil {
+				fmt.Println("not a weight")
+				continue
+			}
+			if err := p.SetWeight(words[1], uint(weight)); err != nil {
+				fmt.Println(err)
+			}
+		case "drain":
+			if len(words) != 3 {
+				fmt.Println("?")
+				continue
+			}
+			seconds, err := strconv.ParseUint(words[2], 10, 0)
+			if err != nil {
+				fmt.Println("not a number of seconds")
+				continue
+			}
+			err = p.Drain(words[1], time.Duration(seconds)*time.Second)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "flows":
+			if len(words) != 2 {
+				fmt.Println("?")
+				continue
+			}
+			n, ok := p.Flows(words[1])
+			if !ok {
+				fmt.Println("no such backend")
+				continue
+			}
+			state := ""
+			if p.Draining(words[1]) {
+				state = ", draining"
+			}
+			fmt.Printf("%d flows%s\n", n, state)
+		case "balance":
+			for _, s := range mm.Balance() {
+				fmt.Printf("%v: weight %d, %d slots, ideally %.1f\n",
+					net.IP(s.Backend.IP), s.Weight, s.Slots, s.Ideal)
+			}
+		case "disruption":
+			slots := mm.Slots()
+			fmt.Printf("%.1f%% of slots moved since last asked\n",
+				100*maglev.Disruption(marked, slots))
+			marked = slots
+		case "export":
+			if len(words) != 2 {
+				fmt.Println("?")
+				continue
+			}
+			dat, err := json.MarshalIndent(mm.Export(), "", "  ")
+			if err == nil {
+				err = os.WriteFile(words[1], dat, 0644)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
 		case "lookup":
-			l := lookupPackets(tt, testPackets)
+			l := lookupPackets(p, testPackets)
 			fmt.Printf("5-tuple to Server mapping:\n")
-			for _, p := range testPackets {
-				fmt.Printf("%v: %v\n", p, l[p])
+			for _, packet := range testPackets {
+				fmt.Printf("%v: %v\n", packet, l[packet])
 			}
 		default:
 			fmt.Println("?")
@@ -138,14 +183,19 @@ func main() {
 	}
 }
 
-func lookupPackets(tt *tracking.Cache, packets []string) map[string][]byte {
+func lookupPackets(p *pool.Pool, packets []string) map[string][]byte {
 	ret := make(map[string][]byte)
-	for _, p := range packets {
-		key := common.NewFiveTuple([]byte(p)).Hash()
-		if serv, ok := tt.Lookup(key); ok {
-			ret[p] = serv.IP
+	for _, packet := range packets {
+		t, err := common.ParseFiveTuple(packet)
+		if err != nil {
+			log.Printf("bad five-tuple %v: %v\n", packet, err)
+			ret[packet] = nil
+			continue
+		}
+		if serv, ok := p.Lookup(t); ok {
+			ret[packet] = serv.IP
 		} else {
-			ret[p] = nil
+			ret[packet] = nil
 		}
 	}
 	return ret
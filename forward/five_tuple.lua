@@ -7,10 +7,14 @@ local ipv4_five_tuple_len = 14
 local ipv6_five_tuple = ffi.typeof("char[38]")
 local ipv6_five_tuple_len = 38
 
--- Create a five-tuple
-function five_tuple(ip_protocol, src, src_port, dst, dst_port)
+-- Create a five-tuple, in the binary encoding of common.FiveTuple:
+-- the L4 protocol, source port and destination port as little-endian
+-- 16-bit integers, followed by the source and destination addresses.
+-- ip_type (int) -- L3_IPV4 or L3_IPV6
+-- l4_type (int) -- IP protocol number, e.g. L4_TCP
+function five_tuple(ip_type, l4_type, src, src_port, dst, dst_port)
    local t, t_len
-   if ip_protocol == L3_IPV4 then
+   if ip_type == L3_IPV4 then
       t = ipv4_five_tuple()
       t_len = ipv4_five_tuple_len
       ffi.copy(t + 6, src, 4)
@@ -21,8 +25,8 @@ function five_tuple(ip_protocol, src, src_port, dst, dst_port)
       ffi.copy(t + 6, src, 16)
       ffi.copy(t + 22, dst, 16)
    end
-   t[0] = band(ip_protocol, 0xff)
-   t[1] = band(rshift(ip_protocol, 8), 0xff)
+   t[0] = band(l4_type, 0xff)
+   t[1] = band(rshift(l4_type, 8), 0xff)
    t[2] = band(src_port, 0xff)
    t[3] = band(rshift(src_port, 8), 0xff)
    t[4] = band(dst_port, 0xff)
@@ -0,0 +1,183 @@
+// Package forward implements a packet forwarding data plane in Go.  It
+// mirrors rewriting.lua: packets are parsed, looked up by five-tuple,
+// usually in a pool.Services, and GRE-encapsulated towards the chosen
+// backend.
+package forward
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/tracking"
+)
+
+const defaultTTL = 30
+
+// Options configures a Forwarder.
+type Options struct {
+	// SrcMAC is the MAC address to send from.  If nil, the
+	// destination MAC of incoming packets is used.
+	SrcMAC net.HardwareAddr
+	// DstMAC is the MAC address to send packets to.
+	DstMAC net.HardwareAddr
+
+	// IPv4 and IPv6 are the addresses of the spike, used as the
+	// source of encapsulated packets.  At least one must be set.
+	IPv4 net.IP
+	IPv6 net.IP
+
+	// TTL is the TTL to set on outgoing packets; it defaults to 30.
+	TTL uint8
+}
+
+// A LookupFunc returns the backend for a packet with the given
+// five-tuple and TCP flags, or false if no backend is available.
+// pool.Services.LookupPacket is a LookupFunc.
+type LookupFunc func(common.FiveTuple, tracking.TCPFlags) (*common.Backend, bool)
+
+// Forwarder encapsulates packets towards the backends chosen by a
+// connection-tracking table.
+//
+// Forwarder is safe for concurrent use if its LookupFunc is, as
+// pool.Services.Lookup is.
+type Forwarder struct {
+	lookup LookupFunc
+	opts   Options
+}
+
+// New constructs a new Forwarder which uses lookup to choose backends.
+func New(lookup LookupFunc, opts Options) (*Forwarder, error) {
+	if len(opts.DstMAC) != 6 {
+		return nil, errors.New("need to specify DstMAC")
+	}
+	if opts.SrcMAC != nil && len(opts.SrcMAC) != 6 {
+		return nil, errors.New("SrcMAC is not an Ethernet address")
+	}
+	if opts.IPv4 != nil {
+		if opts.IPv4 = opts.IPv4.To4(); opts.IPv4 == nil {
+			return nil, errors.New("IPv4 is not an IPv4 address")
+		}
+	}
+	if opts.IPv6 != nil {
+		if opts.IPv6 = opts.IPv6.To16(); opts.IPv6 == nil {
+			return nil, errors.New("IPv6 is not an IPv6 address")
+		}
+	}
+	if opts.IPv4 == nil && opts.IPv6 == nil {
+		return nil, errors.New("need to specify IPv4 or IPv6")
+	}
+	if opts.TTL == 0 {
+		opts.TTL = defaultTTL
+	}
+	return &Forwarder{lookup: lookup, opts: opts}, nil
+}
+
+// Forward processes a single Ethernet frame.  It returns the
+// encapsulated frame, or false if the frame should be dropped.
+func (f *Forwarder) Forward(frame []byte) ([]byte, bool) {
+	p, err := Parse(frame)
+	if err != nil {
+		return nil, false
+	}
+	backend, ok := f.lookup(p.FiveTuple(), p.TCPFlags)
+	if !ok {
+		return nil, false
+	}
+	return f.encapsulate(p, backend.IP)
+}
+
+func (f *Forwarder) encapsulate(p *Packet, backendIP []byte) ([]byte, bool) {
+	var outerType uint16
+	var outerLen int
+	switch len(backendIP) {
+	case net.IPv4len:
+		if f.opts.IPv4 == nil {
+			return nil, false
+		}
+		outerType, outerLen = etherTypeIPv4, ipv4HeaderLen
+	case net.IPv6len:
+		if f.opts.IPv6 == nil {
+			return nil, false
+		}
+		outerType, outerLen = etherTypeIPv6, ipv6HeaderLen
+	default:
+		return nil, false
+	}
+
+	out := make([]byte,
+		ethernetHeaderLen+outerLen+greHeaderLen+len(p.IP))
+
+	eth := out[:ethernetHeaderLen]
+	if f.opts.SrcMAC != nil {
+		copy(eth[6:12], f.opts.SrcMAC)
+	} else {
+		copy(eth[6:12], p.EthDst)
+	}
+	copy(eth[0:6], f.opts.DstMAC)
+	binary.BigEndian.PutUint16(eth[12:14], outerType)
+
+	ip := out[ethernetHeaderLen : ethernetHeaderLen+outerLen]
+	payloadLen := greHeaderLen + len(p.IP)
+	if outerType == etherTypeIPv4 {
+		ip[0] = 4<<4 | ipv4HeaderLen/4
+		binary.BigEndian.PutUint16(ip[2:4], uint16(outerLen+payloadLen))
+		ip[8] = f.opts.TTL
+		ip[9] = protocolGRE
+		copy(ip[12:16], f.opts.IPv4)
+		copy(ip[16:20], backendIP)
+		binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+	} else {
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:6], uint16(payloadLen))
+		ip[6] = protocolGRE
+		ip[7] = f.opts.TTL
+		copy(ip[8:24], f.opts.IPv6)
+		copy(ip[24:40], backendIP)
+	}
+
+	gre := out[ethernetHeaderLen+outerLen:]
+	binary.BigEndian.PutUint16(gre[2:4], p.EtherType)
+	copy(gre[greHeaderLen:], p.IP)
+
+	return out, true
+}
+
+// checksum computes the internet checksum of an IPv4 header whose
+// checksum field is zero.
+func checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// Run forwards every packet from r to w, like the snabb pipeline in
+// spike.lua.  It returns the number of packets forwarded and dropped.
+func (f *Forwarder) Run(r *PcapReader, w *PcapWriter) (int, int, error) {
+	forwarded, dropped := 0, 0
+	for {
+		frame, ts, err := r.ReadPacket()
+		if err == io.EOF {
+			return forwarded, dropped, nil
+		}
+		if err != nil {
+			return forwarded, dropped, err
+		}
+		out, ok := f.Forward(frame)
+		if !ok {
+			dropped++
+			continue
+		}
+		if err := w.WritePacket(out, ts); err != nil {
+			return forwarded, dropped, err
+		}
+		forwarded++
+	}
+}
@@ -0,0 +1,233 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/maglev"
+	"github.com/sipb/spike/tracking"
+)
+
+var (
+	spikeMAC  = net.HardwareAddr{0x38, 0xc3, 0x0d, 0x1d, 0x34, 0xdf}
+	routerMAC = net.HardwareAddr{0xce, 0xd2, 0x85, 0x61, 0x1e, 0x01}
+	spikeIP   = net.IPv4(192, 168, 1, 0).To4()
+	clientIP  = net.IPv4(1, 0, 0, 0).To4()
+	vipIP     = net.IPv4(18, 0, 0, 0).To4()
+)
+
+// makeFrame synthesizes an Ethernet frame carrying a TCP packet from
+// src to dst, followed by Ethernet padding.
+func makeFrame(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	payload := []byte("hello world")
+	var ip []byte
+	etherType := uint16(etherTypeIPv4)
+	l4Len := 20 + len(payload)
+	if src.To4() != nil {
+		ip = make([]byte, ipv4HeaderLen+l4Len)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+		ip[8] = 64
+		ip[9] = protocolTCP
+		copy(ip[12:16], src.To4())
+		copy(ip[16:20], dst.To4())
+		binary.BigEndian.PutUint16(ip[10:12], checksum(ip[:ipv4HeaderLen]))
+	} else {
+		etherType = etherTypeIPv6
+		ip = make([]byte, ipv6HeaderLen+l4Len)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:6], uint16(l4Len))
+		ip[6] = protocolTCP
+		ip[7] = 64
+		copy(ip[8:24], src)
+		copy(ip[24:40], dst)
+	}
+	l4 := ip[len(ip)-l4Len:]
+	binary.BigEndian.PutUint16(l4[0:2], srcPort)
+	binary.BigEndian.PutUint16(l4[2:4], dstPort)
+	l4[12] = 5 << 4
+	l4[13] = byte(tracking.TCPACK)
+	copy(l4[20:], payload)
+
+	frame := make([]byte, ethernetHeaderLen, ethernetHeaderLen+len(ip)+4)
+	copy(frame[0:6], spikeMAC)
+	copy(frame[6:12], routerMAC)
+	binary.BigEndian.PutUint16(frame[12:14], etherType)
+	frame = append(frame, ip...)
+	return append(frame, 0, 0, 0, 0)
+}
+
+func newForwarder(t *testing.T, backends ...*common.Backend) *Forwarder {
+	mm := maglev.New(maglev.SmallM)
+	for _, b := range backends {
+		mm.Add(b)
+	}
+	tt := tracking.New(mm.Lookup, time.Minute)
+	lookup := func(t common.FiveTuple, flags tracking.TCPFlags) (*common.Backend, bool) {
+		return tt.LookupFlow(t.Hash(), t.Protocol, flags)
+	}
+	f, err := New(lookup, Options{
+		DstMAC: routerMAC,
+		IPv4:   spikeIP,
+		IPv6:   net.ParseIP("::ffff:c0a8:100"),
+	})
+	require.NoError(t, err)
+	return f
+}
+
+func TestParse(t *testing.T) {
+	frame := makeFrame(clientIP, vipIP, 12345, 80)
+	p, err := Parse(frame)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(protocolTCP), p.Protocol)
+	assert.Equal(t, netip.MustParseAddr("1.0.0.0"), p.Src)
+	assert.Equal(t, netip.MustParseAddr("18.0.0.0"), p.Dst)
+	assert.Equal(t, uint16(12345), p.SrcPort)
+	assert.Equal(t, uint16(80), p.DstPort)
+	assert.Equal(t, tracking.TCPACK, p.TCPFlags)
+	assert.Equal(t, len(frame)-ethernetHeaderLen-4, len(p.IP),
+		"Ethernet padding was not stripped")
+
+	_, err = Parse(frame[:ethernetHeaderLen+10])
+	assert.Equal(t, ErrTruncated, err)
+
+	arp := append([]byte(nil), frame...)
+	binary.BigEndian.PutUint16(arp[12:14], 0x0806)
+	_, err = Parse(arp)
+	assert.Equal(t, ErrNotIP, err)
+
+	v6 := append([]byte(nil), frame...)
+	v6[ethernetHeaderLen] = 6<<4 | 5
+	_, err = Parse(v6)
+	assert.Equal(t, ErrIPVersion, err)
+
+	// fragments, including the first, are dropped
+	for _, frag := range []uint16{0x2000, 0x0010, 0x2010} {
+		f := append([]byte(nil), frame...)
+		binary.BigEndian.PutUint16(f[ethernetHeaderLen+6:], frag)
+		_, err = Parse(f)
+		assert.Equal(t, ErrFragment, err, "%#x", frag)
+	}
+}
+
+func TestForwardIPv4(t *testing.T) {
+	backend := &common.Backend{
+		IP:        []byte{10, 0, 0, 7},
+		Unhealthy: make(chan struct{}),
+	}
+	f := newForwarder(t, backend)
+
+	frame := makeFrame(clientIP, vipIP, 12345, 80)
+	out, ok := f.Forward(frame)
+	require.True(t, ok, "packet was dropped")
+
+	assert.Equal(t, routerMAC, net.HardwareAddr(out[0:6]))
+	assert.Equal(t, spikeMAC, net.HardwareAddr(out[6:12]),
+		"source MAC should default to incoming destination MAC")
+	assert.Equal(t, uint16(etherTypeIPv4), binary.BigEndian.Uint16(out[12:14]))
+
+	ip := out[ethernetHeaderLen:]
+	assert.Equal(t, len(ip), int(binary.BigEndian.Uint16(ip[2:4])))
+	assert.Equal(t, uint8(protocolGRE), ip[9])
+	assert.Equal(t, uint8(defaultTTL), ip[8])
+	assert.True(t, spikeIP.Equal(ip[12:16]))
+	assert.Equal(t, backend.IP, ip[16:20])
+	assert.Zero(t, checksum(ip[:ipv4HeaderLen]), "bad checksum")
+
+	gre := ip[ipv4HeaderLen:]
+	assert.Equal(t, uint16(etherTypeIPv4), binary.BigEndian.Uint16(gre[2:4]))
+	assert.Equal(t, frame[ethernetHeaderLen:len(frame)-4],
+		gre[greHeaderLen:], "inner packet was modified")
+}
+
+func TestForwardIPv6Backend(t *testing.T) {
+	backend := &common.Backend{
+		IP:        net.ParseIP("2001:db8::7"),
+		Unhealthy: make(chan struct{}),
+	}
+	f := newForwarder(t, backend)
+
+	frame := makeFrame(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"),
+		12345, 80)
+	out, ok := f.Forward(frame)
+	require.True(t, ok, "packet was dropped")
+
+	assert.Equal(t, uint16(etherTypeIPv6), binary.BigEndian.Uint16(out[12:14]))
+	ip := out[ethernetHeaderLen:]
+	assert.Equal(t, len(ip)-ipv6HeaderLen,
+		int(binary.BigEndian.Uint16(ip[4:6])))
+	assert.Equal(t, uint8(protocolGRE), ip[6])
+	assert.Equal(t, []byte(backend.IP), ip[24:40])
+	gre := ip[ipv6HeaderLen:]
+	assert.Equal(t, uint16(etherTypeIPv6), binary.BigEndian.Uint16(gre[2:4]))
+}
+
+func TestForwardNoBackends(t *testing.T) {
+	f := newForwarder(t)
+	_, ok := f.Forward(makeFrame(clientIP, vipIP, 12345, 80))
+	assert.False(t, ok, "packet forwarded with no backends")
+}
+
+func TestRunPcap(t *testing.T) {
+	backends := []*common.Backend{
+		{IP: []byte{10, 0, 0, 1}, Unhealthy: make(chan struct{})},
+		{IP: []byte{10, 0, 0, 2}, Unhealthy: make(chan struct{})},
+	}
+	f := newForwarder(t, backends...)
+
+	var in bytes.Buffer
+	w, err := NewPcapWriter(&in)
+	require.NoError(t, err)
+	ts := time.Unix(1500000000, 123000)
+	for port := uint16(1000); port < 1100; port++ {
+		require.NoError(t, w.WritePacket(
+			makeFrame(clientIP, vipIP, port, 80), ts))
+	}
+	require.NoError(t, w.WritePacket([]byte{1, 2, 3}, ts))
+
+	var out bytes.Buffer
+	r, err := NewPcapReader(&in)
+	require.NoError(t, err)
+	w, err = NewPcapWriter(&out)
+	require.NoError(t, err)
+	forwarded, dropped, err := f.Run(r, w)
+	require.NoError(t, err)
+	assert.Equal(t, 100, forwarded)
+	assert.Equal(t, 1, dropped)
+
+	r, err = NewPcapReader(&out)
+	require.NoError(t, err)
+	freq := make(map[string]int)
+	for i := 0; i < forwarded; i++ {
+		frame, pts, err := r.ReadPacket()
+		require.NoError(t, err)
+		assert.True(t, ts.Equal(pts), "timestamp not preserved")
+		ip := frame[ethernetHeaderLen:]
+		freq[net.IP(ip[16:20]).String()]++
+	}
+	assert.Equal(t, 2, len(freq), "both backends should be used")
+}
+
+func TestPcapRecordLength(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapWriter(&buf)
+	require.NoError(t, err)
+	require.NoError(t, w.WritePacket(make([]byte, 100), time.Now()))
+	// claim a 1 GB record
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b[pcapHeaderLen+8:], 1<<30)
+
+	r, err := NewPcapReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	_, _, err = r.ReadPacket()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds snaplen")
+}
@@ -8,6 +8,9 @@ local function read_all(filename)
 end
 
 ffi.cdef(read_all(os.getenv("LOOKUP_H")))
+ffi.cdef[[
+void free(void *ptr);
+]]
 local golib = ffi.load(os.getenv("LOOKUP_SO"))
 
 local GoString = ffi.typeof("GoString")
@@ -16,8 +19,23 @@ local GoInt = ffi.typeof("GoInt")
 
 local M = {}
 
+-- Converts an error string returned by Go into a Lua string, freeing
+-- it.  Returns nil if there is no error.
+local function go_error(err)
+   if err == nil then
+      return nil
+   end
+   local msg = ffi.string(err)
+   ffi.C.free(err)
+   return msg
+end
+
 M.HEALTH_CHECK_NONE = 0
 M.HEALTH_CHECK_HTTP = 1
+M.HEALTH_CHECK_TCP = 2
+M.HEALTH_CHECK_GRPC = 3
+M.HEALTH_CHECK_UDP = 4
+M.HEALTH_CHECK_DNS = 5
 
 function M.Init()
    return golib.Init()
@@ -29,22 +47,60 @@ function M.AddBackend(service, ip, ip_len, health_check_type)
                            health_check_type)
 end
 
+-- Returns nil on success, or an error message.
 function M.AddBackendsFromConfig(config_file)
-   return golib.AddBackendsFromConfigVoid(GoString(config_file, #config_file))
+   return go_error(golib.AddBackendsFromConfigVoid(GoString(config_file, #config_file)))
 end
 
+-- Returns the C strings src_mac, dst_mac, ipv4_addr, ipv6_addr, incap
+-- and outcap as r0 to r5, and r6, which is nil on success, or an error
+-- message.  The caller must free them.
 function M.AddBackendsAndGetSpikeConfig(config_file)
    return golib.AddBackendsAndGetSpikeConfig(GoString(config_file, #config_file))
 end
 
+-- Returns nil on success, or an error message.
+function M.SetBackendWeight(service, weight)
+   return go_error(golib.SetBackendWeight(GoString(service, #service), weight))
+end
+
+-- Stop sending new connections to a backend, and remove it after
+-- timeout seconds.  Returns nil on success, or an error message.
+function M.DrainBackend(service, timeout)
+   return go_error(golib.DrainBackend(GoString(service, #service), timeout))
+end
+
+-- Returns the number of connections tracked to a backend, or -1 if
+-- there is no such backend.
+function M.BackendFlows(service)
+   return tonumber(golib.BackendFlows(GoString(service, #service)))
+end
+
+-- Returns nil on success, or an error message.
+function M.ReloadConfig(config_file)
+   return go_error(golib.ReloadConfig(GoString(config_file, #config_file)))
+end
+
+-- Reload the configuration file when it changes.  SIGHUP is left to
+-- snabb.
+function M.WatchConfig(config_file)
+   return golib.WatchConfig(GoString(config_file, #config_file))
+end
+
+-- Save backends and tracked connections to the snapshot file, if one is
+-- configured.  Returns nil on success, or an error message.
+function M.SaveSnapshot()
+   return go_error(golib.SaveSnapshot())
+end
+
 function M.RemoveBackend(service)
    return golib.RemoveBackend(GoString(service, #service))
 end
 
 local ip_addr_array = ffi.typeof("char[16]")
-function M.Lookup(x, x_len)
+function M.Lookup(x, x_len, tcp_flags)
    local output = GoSlice(ip_addr_array(), 16, 16)
-   local n = golib.Lookup(GoSlice(x, x_len, x_len), output)
+   local n = golib.Lookup(GoSlice(x, x_len, x_len), tcp_flags, output)
    return output.data, n
 end
 
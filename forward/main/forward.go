@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sipb/spike/config"
+	"github.com/sipb/spike/forward"
+	"github.com/sipb/spike/pool"
+)
+
+func main() {
+	configFile := flag.String("config", "http.yaml", "configuration file")
+	wait := flag.Duration("wait", 3*time.Second,
+		"time to wait for backends to come up")
+	flag.Parse()
+
+	cfg := config.Read(*configFile)
+
+	opts := forward.Options{
+		IPv4: net.ParseIP(cfg.IPv4Address),
+		IPv6: net.ParseIP(cfg.IPv6Address),
+	}
+	// The configuration has been validated, so these do not fail.
+	opts.SrcMAC, _ = net.ParseMAC(cfg.SrcMac)
+	opts.DstMAC, _ = net.ParseMAC(cfg.DstMac)
+
+	services := pool.NewServicesFromConfig(cfg)
+	if err := services.SetSync(cfg); err != nil {
+		log.Fatal(err)
+	}
+	services.Watch(*configFile, 5*time.Second, true, nil)
+	fw, err := forward.New(services.LookupPacket, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	time.Sleep(*wait)
+
+	in, err := os.Open(cfg.Incap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	r, err := forward.NewPcapReader(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := os.Create(cfg.Outcap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w, err := forward.NewPcapWriter(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	forwarded, dropped, err := fw.Run(r, w)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("forwarded %d packets, dropped %d\n", forwarded, dropped)
+	services.StopSnapshot()
+	if err := services.SaveSnapshot(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,144 @@
+package forward
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/tracking"
+)
+
+// Numbers from networking_magic_numbers.lua.
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+
+	protocolTCP = 0x06
+	protocolUDP = 0x11
+	protocolGRE = 0x2f
+
+	ipMFFlag = 0x1
+)
+
+const (
+	ethernetHeaderLen = 14
+	ipv4HeaderLen     = 20
+	ipv6HeaderLen     = 40
+	greHeaderLen      = 4
+	tcpFlagsOffset    = 13
+)
+
+// Errors returned by Parse for packets that spike does not forward.
+var (
+	ErrTruncated   = errors.New("packet truncated")
+	ErrNotIP       = errors.New("not an IP packet")
+	ErrIPVersion   = errors.New("IP version does not match EtherType")
+	ErrUnsupported = errors.New("unsupported transport protocol")
+	ErrFragment    = errors.New("IP fragments are not supported")
+)
+
+// A Packet is a parsed Ethernet frame carrying an IPv4 or IPv6 packet.
+type Packet struct {
+	EthDst    net.HardwareAddr
+	EthSrc    net.HardwareAddr
+	EtherType uint16
+
+	// IP is the IP header and payload, without Ethernet padding.
+	IP []byte
+
+	Protocol uint8
+	Src      netip.Addr
+	Dst      netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+
+	// TCPFlags are the flags of a TCP packet, and zero otherwise.
+	TCPFlags tracking.TCPFlags
+}
+
+// Parse parses an Ethernet frame.  The returned packet refers to frame
+// rather than copying it.
+func Parse(frame []byte) (*Packet, error) {
+	if len(frame) < ethernetHeaderLen {
+		return nil, ErrTruncated
+	}
+	p := &Packet{
+		EthDst:    net.HardwareAddr(frame[0:6]),
+		EthSrc:    net.HardwareAddr(frame[6:12]),
+		EtherType: binary.BigEndian.Uint16(frame[12:14]),
+	}
+	ip := frame[ethernetHeaderLen:]
+
+	var l4 []byte
+	switch p.EtherType {
+	case etherTypeIPv4:
+		if len(ip) < ipv4HeaderLen {
+			return nil, ErrTruncated
+		}
+		if ip[0]>>4 != 4 {
+			return nil, ErrIPVersion
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:4]))
+		if ihl < ipv4HeaderLen || total < ihl || total > len(ip) {
+			return nil, ErrTruncated
+		}
+		p.IP = ip[:total]
+		p.Protocol = ip[9]
+		p.Src = netip.AddrFrom4([4]byte(ip[12:16]))
+		p.Dst = netip.AddrFrom4([4]byte(ip[16:20]))
+		flags := ip[6] >> 5
+		fragOff := binary.BigEndian.Uint16(ip[6:8]) & 0x1fff
+		if fragOff != 0 || flags&ipMFFlag != 0 {
+			// Only the first fragment has ports, so fragments would
+			// be sent to a different backend than the rest of their
+			// connection.  TODO: redirect fragments to the spike that
+			// reassembles them, as rewriting.lua intends to.
+			return nil, ErrFragment
+		}
+		l4 = p.IP[ihl:]
+	case etherTypeIPv6:
+		if len(ip) < ipv6HeaderLen {
+			return nil, ErrTruncated
+		}
+		if ip[0]>>4 != 6 {
+			return nil, ErrIPVersion
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(ip[4:6]))
+		if total > len(ip) {
+			return nil, ErrTruncated
+		}
+		p.IP = ip[:total]
+		p.Protocol = ip[6]
+		p.Src = netip.AddrFrom16([16]byte(ip[8:24]))
+		p.Dst = netip.AddrFrom16([16]byte(ip[24:40]))
+		l4 = p.IP[ipv6HeaderLen:]
+	default:
+		return nil, ErrNotIP
+	}
+
+	switch p.Protocol {
+	case protocolTCP, protocolUDP:
+		if len(l4) < 4 {
+			return nil, ErrTruncated
+		}
+		p.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+		p.DstPort = binary.BigEndian.Uint16(l4[2:4])
+		if p.Protocol == protocolTCP && len(l4) > tcpFlagsOffset {
+			p.TCPFlags = tracking.TCPFlags(l4[tcpFlagsOffset])
+		}
+	default:
+		// Redirected fragments (GRE) are reassembled by the snabb
+		// data plane only.
+		return nil, ErrUnsupported
+	}
+	return p, nil
+}
+
+// FiveTuple returns the packet's five-tuple.
+func (p *Packet) FiveTuple() common.FiveTuple {
+	return common.NewFiveTuple(p.Protocol,
+		p.Src, p.SrcPort, p.Dst, p.DstPort)
+}
@@ -0,0 +1,120 @@
+package forward
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapMagicNano    = 0xa1b23c4d
+	pcapHeaderLen    = 24
+	pcapRecordLen    = 16
+	pcapSnapLen      = 65535
+	pcapMaxSnapLen   = 262144 // the largest snaplen tcpdump uses
+	linkTypeEthernet = 1
+)
+
+// PcapReader reads Ethernet frames from a pcap file, like snabb's
+// PcapReader app.
+type PcapReader struct {
+	r       io.Reader
+	order   binary.ByteOrder
+	nano    bool
+	snapLen uint32
+}
+
+// NewPcapReader reads the pcap file header from r.
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	var hdr [pcapHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("cannot read pcap header: %v", err)
+	}
+	pr := &PcapReader{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagic:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagic:
+		pr.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagicNano:
+		pr.order, pr.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicNano:
+		pr.order, pr.nano = binary.BigEndian, true
+	default:
+		return nil, errors.New("not a pcap file")
+	}
+	if link := pr.order.Uint32(hdr[20:24]); link != linkTypeEthernet {
+		return nil, fmt.Errorf("unsupported pcap link type %d", link)
+	}
+	pr.snapLen = pr.order.Uint32(hdr[16:20])
+	if pr.snapLen == 0 || pr.snapLen > pcapMaxSnapLen {
+		pr.snapLen = pcapMaxSnapLen
+	}
+	return pr, nil
+}
+
+// ReadPacket returns the next frame and its timestamp, or io.EOF if
+// there are no more frames.
+func (r *PcapReader) ReadPacket() ([]byte, time.Time, error) {
+	var hdr [pcapRecordLen]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated pcap record header")
+		}
+		return nil, time.Time{}, err
+	}
+	sec := int64(r.order.Uint32(hdr[0:4]))
+	frac := int64(r.order.Uint32(hdr[4:8]))
+	if !r.nano {
+		frac *= int64(time.Microsecond)
+	}
+	// bound the length before allocating, so that a corrupt file
+	// cannot exhaust memory
+	n := r.order.Uint32(hdr[8:12])
+	if n > r.snapLen {
+		return nil, time.Time{}, fmt.Errorf(
+			"pcap record length %d exceeds snaplen %d", n, r.snapLen)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, time.Time{}, errors.New("truncated pcap record")
+	}
+	return data, time.Unix(sec, frac), nil
+}
+
+// PcapWriter writes Ethernet frames to a pcap file, like snabb's
+// PcapWriter app.
+type PcapWriter struct {
+	w io.Writer
+}
+
+// NewPcapWriter writes a pcap file header to w.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	var hdr [pcapHeaderLen]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeEthernet)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket writes a frame with the given timestamp.
+func (w *PcapWriter) WritePacket(data []byte, ts time.Time) error {
+	var hdr [pcapRecordLen]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(data)))
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(data)
+	return err
+}
@@ -19,9 +19,10 @@ local IPFragReassembly = require("ip_frag/reassembly")
 
 _G._NAME = "rewriting"  -- Snabb requires this for some reason
 
--- Return the backend associated with a five-tuple
-local function get_backend(five_tuple, five_tuple_len)
-   return godefs.Lookup(five_tuple, five_tuple_len)
+-- Return the backend associated with a five-tuple, updating the
+-- connection's tracked state from the packet's TCP flags
+local function get_backend(five_tuple, five_tuple_len, tcp_flags)
+   return godefs.Lookup(five_tuple, five_tuple_len, tcp_flags)
 end
 
 
@@ -95,6 +96,7 @@ end
 -- new_datagram (datagram) -- Datagram to forward. Should have Ethernet
 --    header popped or missing, and IP header parsed.
 -- new_datagram_len (int) -- Length of new_datagram.
+-- tcp_flags (int) -- TCP flags of the packet, or 0 if it is not TCP.
 function Rewriting:handle_fragmentation_and_get_forwarding_params(datagram, ip_header, ip_type)
    local ip_src = ip_header:src()
    local ip_dst = ip_header:dst()
@@ -115,9 +117,10 @@ function Rewriting:handle_fragmentation_and_get_forwarding_params(datagram, ip_h
       if frag_off ~= 0 or mf then
          -- Packet is an IPv4 fragment; redirect to another spike
          -- Set ports to zero to get three-tuple
-         local t3, t3_len = five_tuple(ip_type, ip_src, 0, ip_dst, 0)
+         local t3, t3_len = five_tuple(ip_type, l4_type,
+                                       ip_src, 0, ip_dst, 0)
          -- TODO: Return spike backend pool
-         return true, t3, t3_len, nil, datagram, ip_total_length
+         return true, t3, t3_len, nil, datagram, ip_total_length, 0
       end
    end
 
@@ -132,6 +135,7 @@ function Rewriting:handle_fragmentation_and_get_forwarding_params(datagram, ip_h
       ip_src = new_ip_header:src()
       ip_dst = new_ip_header:dst()
       ip_total_length = new_ip_header:total_length()
+      l4_type = new_ip_header:protocol()
       prot_class = new_ip_header:upper_layer()
    elseif not (l4_type == L4_TCP or l4_type == L4_UDP) then
       return false
@@ -143,14 +147,18 @@ function Rewriting:handle_fragmentation_and_get_forwarding_params(datagram, ip_h
    end
    local src_port = prot_header:src_port()
    local dst_port = prot_header:dst_port()
+   local tcp_flags = 0
+   if l4_type == L4_TCP then
+      tcp_flags = band(prot_header:flags(), 0xff)
+   end
 
-   local t, t_len = five_tuple(ip_type,
+   local t, t_len = five_tuple(ip_type, l4_type,
                                ip_src, src_port, ip_dst, dst_port)
    -- TODO: Use IP destination to determine backend pool.
 
    -- unparse L4
    datagram:unparse(1)
-   return true, t, t_len, nil, datagram, ip_total_length
+   return true, t, t_len, nil, datagram, ip_total_length, tcp_flags
 end
 
 function Rewriting:process_packet(i, o)
@@ -180,7 +188,7 @@ function Rewriting:process_packet(i, o)
    end
 
    local forward_datagram, t, t_len,
-      backend_pool, new_datagram, ip_total_length =
+      backend_pool, new_datagram, ip_total_length, tcp_flags =
          self:handle_fragmentation_and_get_forwarding_params(
             datagram, ip_header, l3_type
          )
@@ -193,7 +201,7 @@ function Rewriting:process_packet(i, o)
       datagram = new_datagram
    end
 
-   local backend, backend_len = get_backend(t, t_len)
+   local backend, backend_len = get_backend(t, t_len, tcp_flags)
    if backend_len == 0 then
       P.free(p)
       return
@@ -0,0 +1,157 @@
+package health
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNSTypes are the query types a DNS health check may ask for, by name.
+var DNSTypes = map[string]uint16{
+	"A":     1,
+	"NS":    2,
+	"CNAME": 5,
+	"SOA":   6,
+	"PTR":   12,
+	"MX":    15,
+	"TXT":   16,
+	"AAAA":  28,
+	"SRV":   33,
+	"ANY":   255,
+}
+
+// DNSRCodes are the response codes a DNS health check may accept, by
+// name.
+var DNSRCodes = map[string]int{
+	"NOERROR":  0,
+	"FORMERR":  1,
+	"SERVFAIL": 2,
+	"NXDOMAIN": 3,
+	"NOTIMP":   4,
+	"REFUSED":  5,
+}
+
+const (
+	dnsHeaderLen = 12
+	dnsClassIN   = 1
+	dnsQR        = 1 << 15 // the flag of responses
+	dnsRD        = 1 << 8  // recursion desired
+	dnsOpcode    = 0xf << 11
+	dnsRCode     = 0xf
+)
+
+// A DNSCheck is a DNS health check, which queries a name over UDP.
+// Zero fields mean the defaults.
+type DNSCheck struct {
+	Address string // host:port
+	Name    string // the root by default
+	Type    uint16 // A by default
+
+	// RCodes are the response codes of a healthy response; by default,
+	// only NOERROR.
+	RCodes []int
+}
+
+// Check performs the health check, succeeding if a response to the
+// query with one of the expected response codes arrives within
+// timeout.
+func (c *DNSCheck) Check(timeout time.Duration) bool {
+	id := uint16(rand.Uint32())
+	query, err := c.query(id)
+	if err != nil {
+		return false
+	}
+
+	deadline := time.Now().Add(timeout)
+	conn, err := net.DialTimeout("udp", c.Address, timeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(query); err != nil {
+		return false
+	}
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return false
+		}
+		resp := buf[:n]
+		// ignore anything but the response to this query
+		if n < dnsHeaderLen || binary.BigEndian.Uint16(resp) != id {
+			continue
+		}
+		flags := binary.BigEndian.Uint16(resp[2:])
+		if flags&dnsQR == 0 || flags&dnsOpcode != 0 {
+			continue
+		}
+		return c.rcodeOK(int(flags & dnsRCode))
+	}
+}
+
+func (c *DNSCheck) rcodeOK(rcode int) bool {
+	if len(c.RCodes) == 0 {
+		return rcode == DNSRCodes["NOERROR"]
+	}
+	for _, r := range c.RCodes {
+		if rcode == r {
+			return true
+		}
+	}
+	return false
+}
+
+// query returns the query with the given ID.
+func (c *DNSCheck) query(id uint16) ([]byte, error) {
+	qtype := c.Type
+	if qtype == 0 {
+		qtype = DNSTypes["A"]
+	}
+	q := make([]byte, dnsHeaderLen, 512)
+	binary.BigEndian.PutUint16(q, id)
+	binary.BigEndian.PutUint16(q[2:], dnsRD)
+	binary.BigEndian.PutUint16(q[4:], 1) // one question
+	q, err := appendDNSName(q, c.Name)
+	if err != nil {
+		return nil, err
+	}
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	return binary.BigEndian.AppendUint16(q, dnsClassIN), nil
+}
+
+// appendDNSName appends a domain name in wire format.
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, errors.New("DNS name is too long")
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, errors.New("DNS name has an invalid label")
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// ValidDNSName returns whether a DNS health check can query name.
+func ValidDNSName(name string) bool {
+	_, err := appendDNSName(nil, name)
+	return err == nil
+}
+
+// DNS performs a DNS health check, which queries the A records of name
+// at address, written host:port, and succeeds if a NOERROR response
+// arrives within timeout.
+func DNS(address, name string, timeout time.Duration) bool {
+	c := &DNSCheck{Address: address, Name: name}
+	return c.Check(timeout)
+}
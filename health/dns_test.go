@@ -0,0 +1,91 @@
+package health
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveDNS answers queries for the A records of names with the given
+// response codes, and does not answer queries for any other names.
+func serveDNS(t *testing.T, rcodes map[string]int) string {
+	return serveUDP(t, func(query []byte) []byte {
+		if len(query) < dnsHeaderLen {
+			return nil
+		}
+		for name, rcode := range rcodes {
+			q, _ := appendDNSName(nil, name)
+			q = binary.BigEndian.AppendUint16(q, DNSTypes["A"])
+			q = binary.BigEndian.AppendUint16(q, dnsClassIN)
+			if !bytes.Equal(query[dnsHeaderLen:], q) {
+				continue
+			}
+			resp := append([]byte(nil), query...)
+			flags := binary.BigEndian.Uint16(resp[2:])
+			binary.BigEndian.PutUint16(resp[2:], flags|dnsQR|uint16(rcode))
+			return resp
+		}
+		return nil
+	})
+}
+
+func TestDNS(t *testing.T) {
+	addr := serveDNS(t, map[string]int{
+		"spike.mit.edu": DNSRCodes["NOERROR"],
+		"gone.mit.edu":  DNSRCodes["NXDOMAIN"],
+		"":              DNSRCodes["REFUSED"],
+	})
+
+	assert.True(t, DNS(addr, "spike.mit.edu", time.Second))
+	assert.True(t, DNS(addr, "spike.mit.edu.", time.Second),
+		"fully-qualified name is not healthy")
+	assert.False(t, DNS(addr, "gone.mit.edu", time.Second),
+		"NXDOMAIN is healthy")
+	assert.False(t, DNS(addr, "", time.Second), "REFUSED is healthy")
+
+	c := &DNSCheck{
+		Address: addr,
+		Name:    "gone.mit.edu",
+		RCodes:  []int{DNSRCodes["NOERROR"], DNSRCodes["NXDOMAIN"]},
+	}
+	assert.True(t, c.Check(time.Second), "expected NXDOMAIN is not healthy")
+
+	start := time.Now()
+	assert.False(t, DNS(addr, "other.mit.edu", 50*time.Millisecond),
+		"no response is healthy")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestDNSWrongID(t *testing.T) {
+	addr := serveUDP(t, func(query []byte) []byte {
+		resp := append([]byte(nil), query...)
+		resp[0]++
+		binary.BigEndian.PutUint16(resp[2:], dnsQR)
+		return resp
+	})
+	assert.False(t, DNS(addr, "spike.mit.edu", 50*time.Millisecond),
+		"response to another query is healthy")
+}
+
+func TestDNSQuery(t *testing.T) {
+	c := &DNSCheck{Name: "mit.edu", Type: DNSTypes["AAAA"]}
+	q, err := c.query(0x1234)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		3, 'm', 'i', 't', 3, 'e', 'd', 'u', 0,
+		0, 28, 0, 1,
+	}, q)
+
+	assert.True(t, ValidDNSName("."))
+	assert.True(t, ValidDNSName("mit.edu."))
+	assert.False(t, ValidDNSName("mit..edu"))
+	assert.False(t, ValidDNSName(string(make([]byte, 64))+".edu"))
+	c.Name = "mit..edu"
+	_, err = c.query(0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// A GRPCCheck is a gRPC health check, which calls
+// grpc.health.v1.Health/Check.
+type GRPCCheck struct {
+	Address string // host:port
+	Service string // the service to check, or "" for the whole server
+
+	TLS *tls.Config // if not nil, connect with TLS
+}
+
+// Check performs the health check, succeeding if the server reports
+// that the service is SERVING within timeout.
+func (c *GRPCCheck) Check(timeout time.Duration) bool {
+	creds := insecure.NewCredentials()
+	if c.TLS != nil {
+		creds = credentials.NewTLS(c.TLS)
+	}
+	conn, err := grpc.NewClient(c.Address,
+		grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx,
+		&healthpb.HealthCheckRequest{Service: c.Service})
+	if err != nil {
+		return false
+	}
+	return resp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+}
+
+// GRPC performs a gRPC health check of a service, or the whole server
+// if service is "", at address, which is host:port, without TLS.
+func GRPC(address, service string, timeout time.Duration) bool {
+	c := &GRPCCheck{Address: address, Service: service}
+	return c.Check(timeout)
+}
@@ -0,0 +1,110 @@
+package health
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// serveGRPC starts a gRPC server with the standard health service on a
+// local port, with TLS if creds is not nil, until the test ends.
+func serveGRPC(t *testing.T, creds credentials.TransportCredentials) (
+	*grpchealth.Server, *grpc.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var opts []grpc.ServerOption
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s := grpc.NewServer(opts...)
+	h := grpchealth.NewServer()
+	healthpb.RegisterHealthServer(s, h)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	return h, s, l.Addr().String()
+}
+
+// selfSigned returns a certificate for 127.0.0.1 and a pool trusting it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		roots
+}
+
+func TestGRPC(t *testing.T) {
+	h, s, addr := serveGRPC(t, nil)
+
+	assert.True(t, GRPC(addr, "", time.Second), "server is not healthy")
+	assert.False(t, GRPC(addr, "spike", time.Second),
+		"unknown service is healthy")
+	h.SetServingStatus("spike", healthpb.HealthCheckResponse_SERVING)
+	assert.True(t, GRPC(addr, "spike", time.Second),
+		"serving service is not healthy")
+	h.SetServingStatus("spike", healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.False(t, GRPC(addr, "spike", time.Second),
+		"not serving service is healthy")
+	assert.True(t, GRPC(addr, "", time.Second), "server is not healthy")
+	h.Shutdown()
+	assert.False(t, GRPC(addr, "", time.Second),
+		"shut down server is healthy")
+
+	s.Stop()
+	assert.False(t, GRPC(addr, "", time.Second), "stopped server is healthy")
+}
+
+func TestGRPCNotGRPC(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("healthy"))
+		}))
+	defer s.Close()
+	assert.False(t, GRPC(strings.TrimPrefix(s.URL, "http://"), "",
+		time.Second), "HTTP/1 server is healthy")
+}
+
+func TestGRPCTLS(t *testing.T) {
+	cert, roots := selfSigned(t)
+	_, _, addr := serveGRPC(t, credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}))
+
+	assert.False(t, GRPC(addr, "", time.Second), "plaintext is healthy")
+	c := &GRPCCheck{Address: addr, TLS: &tls.Config{}}
+	assert.False(t, c.Check(time.Second), "untrusted certificate")
+	c = &GRPCCheck{Address: addr, TLS: &tls.Config{RootCAs: roots}}
+	assert.True(t, c.Check(time.Second), "trusted certificate")
+	c = &GRPCCheck{Address: addr, TLS: &tls.Config{InsecureSkipVerify: true}}
+	assert.True(t, c.Check(time.Second), "skipped verification")
+}
@@ -1,32 +1,162 @@
 package health
 
 import (
-	"io/ioutil"
-	"net/http"
-	"strings"
+	"math/rand"
+	"net"
+	"sync/atomic"
 	"time"
 )
 
+// Options configure a Checker.
+type Options struct {
+	Interval time.Duration // between checks; a second if zero
+	Timeout  time.Duration // passed to each check
+
+	// Rise and Fall are how many consecutive checks must succeed for
+	// the backend to come up, and fail for it to go down.  They are at
+	// least 1.
+	Rise int
+	Fall int
+
+	// Jitter is the fraction of the interval, in [0, 1), by which each
+	// interval is randomly lengthened or shortened, so that checkers
+	// started together do not stay in lockstep.
+	Jitter float64
+
+	// MaxInterval, if longer than Interval, is the longest interval
+	// between checks of a backend which is down: each consecutive
+	// failure doubles the interval up to it.
+	MaxInterval time.Duration
+}
+
+// delay returns how long to wait before the next check.
+func (o Options) delay(healthy bool, failures int) time.Duration {
+	d := o.Interval
+	if !healthy {
+		for i := 1; i < failures && d < o.MaxInterval; i++ {
+			d *= 2
+		}
+		if d > o.MaxInterval && o.MaxInterval > o.Interval {
+			d = o.MaxInterval
+		}
+	}
+	if o.Jitter > 0 {
+		d += time.Duration(float64(d) * o.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// A Checker periodically health checks a backend, reporting when it
+// comes up or goes down.  Its check function and options can be changed
+// while it runs.
+type Checker struct {
+	check   atomic.Value // func(timeout time.Duration) bool
+	options atomic.Value // Options
+}
+
+// Start starts a Checker, which assumes that the backend is initially
+// in the given state, and calls onUp and onDown when it changes.  It
+// runs the first check immediately.  When quit is closed, it stops,
+// calling onDown if the backend was up.
+func Start(healthy bool, check func(timeout time.Duration) bool,
+	opts Options, onUp func(), onDown func(), quit <-chan struct{}) *Checker {
+	c := newChecker(check, opts)
+	go c.run(healthy, onUp, onDown, quit)
+	return c
+}
+
+func newChecker(check func(time.Duration) bool, opts Options) *Checker {
+	c := &Checker{}
+	c.Set(check, opts)
+	return c
+}
+
+// Set changes the check function and options, from the next check on.
+func (c *Checker) Set(check func(timeout time.Duration) bool, opts Options) {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Rise < 1 {
+		opts.Rise = 1
+	}
+	if opts.Fall < 1 {
+		opts.Fall = 1
+	}
+	c.check.Store(check)
+	c.options.Store(opts)
+}
+
+func (c *Checker) run(healthy bool, onUp func(), onDown func(),
+	quit <-chan struct{}) {
+	defer func() {
+		if healthy {
+			onDown()
+		}
+	}()
+
+	var successes, failures int
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-timer.C:
+		}
+
+		opts := c.options.Load().(Options)
+		if c.check.Load().(func(time.Duration) bool)(opts.Timeout) {
+			successes++
+			failures = 0
+			if !healthy && successes >= opts.Rise {
+				healthy = true
+				onUp()
+			}
+		} else {
+			failures++
+			successes = 0
+			if healthy && failures >= opts.Fall {
+				healthy = false
+				onDown()
+			}
+		}
+		timer.Reset(opts.delay(healthy, failures))
+	}
+}
+
+// legacyOptions returns the options which check every pollDelay, and
+// take a backend down once no check has succeeded for healthTimeout.
+func legacyOptions(pollDelay, healthTimeout time.Duration) Options {
+	return Options{
+		Interval: pollDelay,
+		Rise:     1,
+		Fall:     int(healthTimeout/pollDelay) + 1,
+	}
+}
+
+// ignoreTimeout adapts a check function which has its own timeout.
+func ignoreTimeout(f func() bool) func(time.Duration) bool {
+	return func(time.Duration) bool { return f() }
+}
+
 // CheckFun is a wrapper around Check using callback functions.
 func CheckFun(healthCheckFunc func() bool,
 	onUp func(), onDown func(),
 	pollDelay time.Duration,
 	healthTimeout time.Duration, quit <-chan struct{}) {
-	updates := make(chan bool)
-	Check(healthCheckFunc, pollDelay, healthTimeout, updates, quit)
-	go func() {
-		for {
-			up, ok := <-updates
-			if !ok {
-				return
-			}
-			if up {
-				onUp()
-			} else {
-				onDown()
-			}
-		}
-	}()
+	CheckFunFrom(false, healthCheckFunc, onUp, onDown,
+		pollDelay, healthTimeout, quit)
+}
+
+// CheckFunFrom is like CheckFun, but assumes that the backend is
+// initially in the given state.  If it is healthy, onUp is not called
+// unless the backend first goes down.
+func CheckFunFrom(healthy bool, healthCheckFunc func() bool,
+	onUp func(), onDown func(),
+	pollDelay time.Duration,
+	healthTimeout time.Duration, quit <-chan struct{}) {
+	Start(healthy, ignoreTimeout(healthCheckFunc),
+		legacyOptions(pollDelay, healthTimeout), onUp, onDown, quit)
 }
 
 // Check runs asynchronous health checking.  The updates channel
@@ -42,75 +172,22 @@ func Check(
 	updates chan<- bool,
 	quit <-chan struct{},
 ) {
-	go check(healthCheckFunc, pollDelay,
-		healthTimeout, updates, quit)
-}
-
-func check(
-	healthCheckFunc func() bool,
-	pollDelay time.Duration,
-	healthTimeout time.Duration,
-	updates chan<- bool,
-	quit <-chan struct{},
-) {
-	healthy := false
-	defer func() {
-		if healthy {
-			updates <- false
-		}
-		close(updates)
+	c := newChecker(ignoreTimeout(healthCheckFunc),
+		legacyOptions(pollDelay, healthTimeout))
+	go func() {
+		defer close(updates)
+		c.run(false, func() { updates <- true },
+			func() { updates <- false }, quit)
 	}()
-
-	start := time.Now()
-
-	onTick := func() {
-		if healthCheckFunc() {
-			start = time.Now()
-			if !healthy {
-				healthy = true
-				updates <- true
-			}
-		} else if healthy && time.Now().After(start.Add(healthTimeout)) {
-			healthy = false
-			updates <- false
-		}
-	}
-
-	ticker := time.NewTicker(pollDelay)
-	defer ticker.Stop()
-
-	onTick()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-ticker.C:
-			onTick()
-		}
-	}
 }
 
-// HTTP performs a health check by searching for the string "healthy" in
-// the HTTP response body
-func HTTP(healthService string, httpTimeout time.Duration) bool {
-	client := http.Client{
-		Timeout: httpTimeout,
-	}
-
-	resp, err := client.Get(healthService)
-	// Check if response timeouts or returns an HTTP error
+// TCP performs a health check by connecting to a host:port address,
+// succeeding if the connection completes within timeout.
+func TCP(address string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", address, timeout)
 	if err != nil {
 		return false
 	}
-	defer resp.Body.Close()
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false
-	}
-
-	if strings.Contains(string(bytes), "healthy") {
-		return true
-	}
-
-	return false
+	conn.Close()
+	return true
 }
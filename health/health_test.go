@@ -0,0 +1,132 @@
+package health
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A script is a health check whose results are given in advance.  Once
+// they run out, it keeps returning the last one.
+type script struct {
+	results []bool
+	checks  atomic.Int32
+}
+
+func (s *script) check(time.Duration) bool {
+	n := int(s.checks.Add(1)) - 1
+	if n >= len(s.results) {
+		n = len(s.results) - 1
+	}
+	return s.results[n]
+}
+
+func TestRiseFall(t *testing.T) {
+	s := &script{results: []bool{
+		true, false, true, true, // up on the second success in a row
+		false, false, true, false, false, false, // down on the third failure
+	}}
+	// each event is recorded with the number of checks run
+	type event struct {
+		up     bool
+		checks int32
+	}
+	events := make(chan event, 10)
+	quit := make(chan struct{})
+	Start(false, s.check, Options{Interval: time.Millisecond, Rise: 2, Fall: 3},
+		func() { events <- event{true, s.checks.Load()} },
+		func() { events <- event{false, s.checks.Load()} }, quit)
+
+	assert.Equal(t, event{true, 4}, <-events)
+	assert.Equal(t, event{false, 10}, <-events)
+
+	close(quit)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected %+v after quit while down", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestQuitWhileUp(t *testing.T) {
+	s := &script{results: []bool{true}}
+	events := make(chan string, 10)
+	quit := make(chan struct{})
+	Start(true, s.check, Options{Interval: time.Millisecond},
+		func() { events <- "up" }, func() { events <- "down" }, quit)
+	require.Eventually(t, func() bool { return s.checks.Load() > 2 },
+		time.Second, time.Millisecond)
+	close(quit)
+	assert.Equal(t, "down", <-events, "initially healthy backend went up")
+}
+
+func TestSet(t *testing.T) {
+	var healthy atomic.Bool
+	events := make(chan string, 10)
+	quit := make(chan struct{})
+	defer close(quit)
+	c := Start(false, func(time.Duration) bool { return false },
+		Options{Interval: time.Millisecond},
+		func() { events <- "up" }, func() { events <- "down" }, quit)
+
+	healthy.Store(true)
+	var timeout atomic.Int64
+	c.Set(func(d time.Duration) bool {
+		timeout.Store(int64(d))
+		return healthy.Load()
+	}, Options{Interval: time.Millisecond, Timeout: time.Minute})
+	require.Equal(t, "up", <-events)
+	assert.Equal(t, time.Minute, time.Duration(timeout.Load()))
+}
+
+func TestDelay(t *testing.T) {
+	o := Options{Interval: time.Second, MaxInterval: 10 * time.Second}
+	assert.Equal(t, time.Second, o.delay(true, 3), "backed off while up")
+	assert.Equal(t, time.Second, o.delay(false, 1))
+	assert.Equal(t, 2*time.Second, o.delay(false, 2))
+	assert.Equal(t, 8*time.Second, o.delay(false, 4))
+	assert.Equal(t, 10*time.Second, o.delay(false, 5))
+	assert.Equal(t, 10*time.Second, o.delay(false, 100))
+
+	o = Options{Interval: time.Second}
+	assert.Equal(t, time.Second, o.delay(false, 5), "backed off by default")
+
+	o.Jitter = 0.2
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := o.delay(true, 0)
+		assert.InDelta(t, float64(time.Second), float64(d),
+			float64(200*time.Millisecond))
+		seen[d] = true
+	}
+	assert.Greater(t, len(seen), 1, "no jitter")
+}
+
+func TestCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	updates := make(chan bool)
+	quit := make(chan struct{})
+	Check(healthy.Load, time.Millisecond, 3*time.Millisecond, updates, quit)
+	assert.True(t, <-updates)
+	healthy.Store(false)
+	assert.False(t, <-updates)
+	close(quit)
+	_, ok := <-updates
+	assert.False(t, ok, "updates not closed")
+}
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	assert.True(t, TCP(addr, time.Second), "listener is not healthy")
+
+	l.Close()
+	assert.False(t, TCP(addr, time.Second), "closed listener is healthy")
+	assert.False(t, TCP("localhost", time.Second), "address without port")
+}
@@ -0,0 +1,119 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// DefaultBody is what the body of a healthy HTTP response must contain
+// by default: the word "healthy", so that "unhealthy" does not pass.
+var DefaultBody = regexp.MustCompile(`\bhealthy\b`)
+
+// DefaultMaxBody is how much of an HTTP response body is read by
+// default.
+const DefaultMaxBody = 64 << 10
+
+// An HTTPCheck is an HTTP or HTTPS health check.  Zero fields mean the
+// defaults.  It must not be changed once used.
+type HTTPCheck struct {
+	URL    string
+	Method string      // GET by default
+	Host   string      // the Host header, if not the URL's host
+	Header http.Header // other request headers
+
+	// Status are the status codes of a healthy response; by default,
+	// any 2xx code.
+	Status []int
+
+	// Body must match the first MaxBody bytes of the body, except of
+	// the response to a HEAD request; it is DefaultBody by default.
+	Body    *regexp.Regexp
+	MaxBody int64
+
+	TLS *tls.Config // for https URLs
+
+	once   sync.Once
+	client *http.Client
+}
+
+// Check performs the health check, succeeding if a healthy response
+// arrives within timeout.
+func (c *HTTPCheck) Check(timeout time.Duration) bool {
+	c.once.Do(func() {
+		c.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				TLSClientConfig:   c.TLS,
+				DisableKeepAlives: true,
+			},
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	method := c.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.URL, nil)
+	if err != nil {
+		return false
+	}
+	for name, values := range c.Header {
+		req.Header[name] = values
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if !c.statusOK(resp.StatusCode) {
+		return false
+	}
+	if method == http.MethodHead {
+		return true // no body to match
+	}
+
+	max := c.MaxBody
+	if max <= 0 {
+		max = DefaultMaxBody
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, max))
+	if err != nil {
+		return false
+	}
+	re := c.Body
+	if re == nil {
+		re = DefaultBody
+	}
+	return re.Match(body)
+}
+
+func (c *HTTPCheck) statusOK(code int) bool {
+	if len(c.Status) == 0 {
+		return code/100 == 2
+	}
+	for _, s := range c.Status {
+		if code == s {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP performs a health check by fetching a URL, which is healthy if
+// the response has a 2xx status and its body contains the word
+// "healthy".
+func HTTP(url string, timeout time.Duration) bool {
+	c := &HTTPCheck{URL: url}
+	return c.Check(timeout)
+}
@@ -0,0 +1,102 @@
+package health
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTP(t *testing.T) {
+	body := "healthy"
+	status := http.StatusOK
+	var req *http.Request
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			req = r
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+	defer s.Close()
+
+	assert.True(t, HTTP(s.URL, time.Second))
+	body = "unhealthy"
+	assert.False(t, HTTP(s.URL, time.Second), "unhealthy is healthy")
+	body = "healthy"
+	status = http.StatusServiceUnavailable
+	assert.False(t, HTTP(s.URL, time.Second), "503 is healthy")
+	status = http.StatusCreated
+	assert.True(t, HTTP(s.URL, time.Second), "201 is not healthy")
+
+	c := &HTTPCheck{
+		URL:    s.URL,
+		Method: http.MethodPost,
+		Host:   "fries.mit.edu",
+		Header: http.Header{"X-Check": {"spike"}},
+		Status: []int{http.StatusTeapot},
+		Body:   regexp.MustCompile(`^ok$`),
+	}
+	status = http.StatusTeapot
+	body = "ok"
+	assert.True(t, c.Check(time.Second))
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "fries.mit.edu", req.Host)
+	assert.Equal(t, "spike", req.Header.Get("X-Check"))
+	status = http.StatusOK
+	assert.False(t, c.Check(time.Second), "unexpected status is healthy")
+
+	body = "unhealthy"
+	c = &HTTPCheck{URL: s.URL, Method: http.MethodHead}
+	assert.True(t, c.Check(time.Second), "HEAD body is checked")
+}
+
+func TestHTTPMaxBody(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat(".", 100) + "healthy"))
+		}))
+	defer s.Close()
+
+	c := &HTTPCheck{URL: s.URL, MaxBody: 100}
+	assert.False(t, c.Check(time.Second), "read past MaxBody")
+	c = &HTTPCheck{URL: s.URL, MaxBody: 107}
+	assert.True(t, c.Check(time.Second))
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	done := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-done
+		}))
+	defer s.Close()
+	defer close(done)
+
+	start := time.Now()
+	assert.False(t, HTTP(s.URL, 50*time.Millisecond))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestHTTPS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("healthy"))
+		}))
+	defer s.Close()
+
+	assert.False(t, HTTP(s.URL, time.Second), "untrusted certificate")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	c := &HTTPCheck{URL: s.URL, TLS: &tls.Config{RootCAs: roots}}
+	assert.True(t, c.Check(time.Second), "trusted certificate")
+
+	c = &HTTPCheck{URL: s.URL, TLS: &tls.Config{InsecureSkipVerify: true}}
+	assert.True(t, c.Check(time.Second), "skipped verification")
+}
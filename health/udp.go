@@ -0,0 +1,51 @@
+package health
+
+import (
+	"net"
+	"regexp"
+	"time"
+)
+
+// maxDatagram is the largest UDP payload.
+const maxDatagram = 64 << 10
+
+// A UDPCheck is a UDP health check, which sends a request datagram and
+// expects a response.
+type UDPCheck struct {
+	Address string // host:port
+	Request []byte
+
+	// Response must match the response datagram; any response will do
+	// if it is nil.
+	Response *regexp.Regexp
+}
+
+// Check performs the health check, succeeding if a matching response
+// arrives within timeout.
+func (c *UDPCheck) Check(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	conn, err := net.DialTimeout("udp", c.Address, timeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(c.Request); err != nil {
+		return false
+	}
+	buf := make([]byte, maxDatagram)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return false
+	}
+	return c.Response == nil || c.Response.Match(buf[:n])
+}
+
+// UDP performs a UDP health check, which sends request to address,
+// written host:port, and succeeds if a response matching response, or
+// any response if it is nil, arrives within timeout.
+func UDP(address string, request []byte, response *regexp.Regexp,
+	timeout time.Duration) bool {
+	c := &UDPCheck{Address: address, Request: request, Response: response}
+	return c.Check(timeout)
+}
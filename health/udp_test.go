@@ -0,0 +1,58 @@
+package health
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveUDP answers each datagram sent to a local UDP socket with the
+// result of respond, or nothing if it returns nil, until the test ends.
+func serveUDP(t *testing.T, respond func([]byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := respond(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestUDP(t *testing.T) {
+	addr := serveUDP(t, func(req []byte) []byte {
+		switch {
+		case bytes.Equal(req, []byte("ping")):
+			return []byte("pong")
+		case bytes.Equal(req, []byte("status")):
+			return []byte("status: degraded")
+		}
+		return nil
+	})
+
+	pong := regexp.MustCompile(`^pong$`)
+	assert.True(t, UDP(addr, []byte("ping"), nil, time.Second))
+	assert.True(t, UDP(addr, []byte("ping"), pong, time.Second))
+	assert.False(t, UDP(addr, []byte("status"), pong, time.Second),
+		"unexpected response is healthy")
+
+	start := time.Now()
+	assert.False(t, UDP(addr, []byte("hello"), nil, 50*time.Millisecond),
+		"no response is healthy")
+	assert.Less(t, time.Since(start), time.Second)
+	assert.False(t, UDP("localhost", []byte("ping"), nil, time.Second),
+		"address without port")
+}
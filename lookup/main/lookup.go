@@ -5,31 +5,40 @@ import "C"
 import (
 	"fmt"
 	"os"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/sipb/spike/common"
 	"github.com/sipb/spike/config"
-	"github.com/sipb/spike/health"
 	"github.com/sipb/spike/maglev"
+	"github.com/sipb/spike/pool"
 	"github.com/sipb/spike/tracking"
 )
 
+// Health check types, as passed by godefs.lua.
 const (
 	healthCheckNone = iota
 	healthCheckHTTP
+	healthCheckTCP
+	healthCheckGRPC
+	healthCheckUDP
+	healthCheckDNS
 )
 
-type serviceInfo struct {
-	ip   []byte
-	quit chan<- struct{}
+var healthCheckMap = map[int]string{
+	healthCheckNone: config.HealthCheckNone,
+	healthCheckHTTP: config.HealthCheckHTTP,
+	healthCheckTCP:  config.HealthCheckTCP,
+	healthCheckGRPC: config.HealthCheckGRPC,
+	healthCheckUDP:  config.HealthCheckUDP,
+	healthCheckDNS:  config.HealthCheckDNS,
 }
 
+// How often WatchConfig checks whether the configuration file changed.
+const watchInterval = 5 * time.Second
+
 type globals struct {
-	services     map[string]*serviceInfo
-	servicesLock sync.RWMutex
-	tracker      *tracking.Cache
-	maglev       *maglev.Table
+	services *pool.Services
 }
 
 var g globals
@@ -39,15 +48,19 @@ var g globals
 //
 //export Init
 func Init() {
-	g.services = make(map[string]*serviceInfo)
-	g.maglev = maglev.New(maglev.SmallM)
-	g.tracker = tracking.New(g.maglev.Lookup, 15*time.Minute)
+	g.services = pool.NewServices(common.DefaultLookupKey, maglev.DefaultKey)
 }
 
-// AddBackend adds a new backend to the health checker.
+// AddBackend adds a new backend to the default service's health
+// checker.
 //
 //export AddBackend
 func AddBackend(service string, ip []byte, healthCheckType int) {
+	healthCheck, ok := healthCheckMap[healthCheckType]
+	if !ok {
+		panic("Unrecognized health check type")
+	}
+
 	// make copies of passed-in data to avoid lua gc
 	newServiceBytes := make([]byte, len(service))
 	copy(newServiceBytes, []byte(service))
@@ -55,68 +68,59 @@ func AddBackend(service string, ip []byte, healthCheckType int) {
 	newIP := make([]byte, len(ip))
 	copy(newIP, ip)
 
-	backends := make(chan *common.Backend, 1)
-	quit := make(chan struct{})
-	info := &serviceInfo{newIP, quit}
-
-	var healthCheckFunc func() bool
-	switch healthCheckType {
-	case healthCheckNone:
-		healthCheckFunc = func() bool {
-			return true
-		}
-	case healthCheckHTTP:
-		healthCheckFunc = func() bool {
-			return health.HTTP(newService, 2*time.Second)
-		}
-	default:
-		panic("Unrecognized health check type")
+	g.services.Default().AddBackend(config.Backend{
+		Address:     newService,
+		IP:          newIP,
+		HealthCheck: healthCheck,
+		Weight:      1,
+	})
+}
+
+// SetBackendWeight changes the weight of the backends with the given
+// address in every service.  It returns nil on success, or an error
+// message.
+//
+//export SetBackendWeight
+func SetBackendWeight(service string, weight int) *C.char {
+	if weight < 0 {
+		return errorString(fmt.Errorf("negative weight %d", weight))
 	}
+	return errorString(g.services.SetWeight(service, uint(weight)))
+}
 
-	health.CheckFun(healthCheckFunc,
-		func() {
-			down := make(chan struct{})
-			backend := &common.Backend{
-				IP:        newIP,
-				Unhealthy: down,
-			}
-			backends <- backend
-			g.maglev.Add(backend)
-		},
-		func() {
-			backend := <-backends
-			close(backend.Unhealthy)
-			g.maglev.Remove(backend)
-		},
-		time.Second, 5*time.Second, quit)
-	g.servicesLock.Lock()
-	defer g.servicesLock.Unlock()
-	g.services[newService] = info
-}
-
-var healthCheckMap = map[string]int {
-	"none": healthCheckNone,
-	"http": healthCheckHTTP,
-}
-
-func AddBackendsFromConfig(file string) config.T {
-	cfg := config.Read(file)
+// AddBackendsFromConfig loads a configuration file and adds its
+// services and backends.  Nothing is added if the file is invalid.
+func AddBackendsFromConfig(file string) (config.T, error) {
+	cfg, err := config.Load(file)
+	if err != nil {
+		return cfg, err
+	}
+	g.services.SetKeys(cfg)
+	g.services.SetTimeouts(cfg)
+	g.services.SetSnapshot(cfg)
 	for _, bCfg := range cfg.Backends {
-		healthCheckType, ok := healthCheckMap[bCfg.HealthCheck]
-		if !ok {
-			panic("Unrecognized health check type in config " + bCfg.HealthCheck)
-		}
-		AddBackend(bCfg.Address, bCfg.IP, healthCheckType)
+		g.services.Default().AddBackend(bCfg)
+	}
+	g.services.ReconfigureServices(cfg.Services)
+	return cfg, g.services.SetSync(cfg)
+}
+
+// errorString converts an error into a C string for returning to Lua,
+// which must free it.  It returns nil if there is no error.
+func errorString(err error) *C.char {
+	if err == nil {
+		return nil
 	}
-	return cfg
+	return C.CString(err.Error())
 }
 
 // The common.Config return value can't be exported so unfortunately we need a
-// separate function.
+// separate function.  It returns nil on success, or an error message.
 
 //export AddBackendsFromConfigVoid
-func AddBackendsFromConfigVoid(file string) {
-	AddBackendsFromConfig(file)
+func AddBackendsFromConfigVoid(file string) *C.char {
+	_, err := AddBackendsFromConfig(file)
+	return errorString(err)
 }
 
 // Since Go is garbage-collected and we want to export this function and have
@@ -126,35 +130,91 @@ func AddBackendsFromConfigVoid(file string) {
 // return Go pointers or similar, including Go strings). It's not pretty.
 
 // Also I don't think Go FFI can export Go structs yet, so we're just returning
-// five unnamed values at once...
+// seven unnamed values at once...  The last is nil on success, or an error
+// message, in which case the others are empty.
 
 //export AddBackendsAndGetSpikeConfig
-func AddBackendsAndGetSpikeConfig(file string) (*C.char, *C.char, *C.char, *C.char, *C.char) {
-	cfg := AddBackendsFromConfig(file)
-	return C.CString(cfg.SrcMac), C.CString(cfg.DstMac), C.CString(cfg.IPv4Address), C.CString(cfg.Incap), C.CString(cfg.Outcap)
+func AddBackendsAndGetSpikeConfig(file string) (*C.char, *C.char, *C.char, *C.char, *C.char, *C.char, *C.char) {
+	cfg, err := AddBackendsFromConfig(file)
+	if err != nil {
+		cfg = config.T{}
+	}
+	return C.CString(cfg.SrcMac), C.CString(cfg.DstMac), C.CString(cfg.IPv4Address), C.CString(cfg.IPv6Address), C.CString(cfg.Incap), C.CString(cfg.Outcap), errorString(err)
 }
 
-// RemoveBackend removes a backend from the health checker.
+// DrainBackend stops sending new connections to the backends with the
+// given address in every service, and removes them after timeout
+// seconds.  Connections already tracked to them keep going to them in
+// the meantime.  It returns nil on success, or an error message.
 //
-//export RemoveBackend
-func RemoveBackend(service string) {
-	g.servicesLock.Lock()
-	defer g.servicesLock.Unlock()
-	info, ok := g.services[service]
+//export DrainBackend
+func DrainBackend(service string, timeout int) *C.char {
+	err := g.services.Drain(strings.Clone(service),
+		time.Duration(timeout)*time.Second)
+	return errorString(err)
+}
+
+// BackendFlows returns the number of connections tracked to the
+// backends with the given address in all services, or -1 if there is
+// no such backend.
+//
+//export BackendFlows
+func BackendFlows(service string) int {
+	n, ok := g.services.Flows(service)
 	if !ok {
-		return
+		return -1
 	}
-	close(info.quit)
-	delete(g.services, service)
+	return n
+}
+
+// ReloadConfig re-reads a configuration file and reconciles the set of
+// services and backends with it, keeping tracked connections to
+// backends which did not change.  It returns nil on success, or an
+// error message, in which case nothing is changed.
+//
+//export ReloadConfig
+func ReloadConfig(file string) *C.char {
+	return errorString(g.services.Reload(file))
 }
 
-// Lookup determines the backend associated with a five-tuple.  It
-// stores its result in output, and returns the number of bytes in the
-// output.
+// WatchConfig reloads a configuration file when it changes.  It does
+// not handle SIGHUP, which belongs to the process loading the library;
+// call ReloadConfig instead.
+//
+//export WatchConfig
+func WatchConfig(file string) {
+	g.services.Watch(strings.Clone(file), watchInterval, false, nil)
+}
+
+// SaveSnapshot saves the backends and tracked connections to the
+// configured snapshot file, if any, to be restored when spike next
+// starts.  It returns nil on success, or an error message.
+//
+//export SaveSnapshot
+func SaveSnapshot() *C.char {
+	return errorString(g.services.SaveSnapshot())
+}
+
+// RemoveBackend removes the backends with the given address from every
+// service and stops health checking them.
+//
+//export RemoveBackend
+func RemoveBackend(service string) {
+	g.services.RemoveBackend(service)
+}
+
+// Lookup determines the backend associated with a five-tuple, in the
+// binary encoding of common.FiveTuple, of a packet with the given TCP
+// flags (zero for other protocols).  It stores its result in output,
+// and returns the number of bytes in the output.
 //
 //export Lookup
-func Lookup(fiveTuple []byte, output []byte) int {
-	backend, ok := g.tracker.Lookup(common.NewFiveTuple(fiveTuple).Hash())
+func Lookup(fiveTuple []byte, tcpFlags int, output []byte) int {
+	t, err := common.FiveTupleFromBytes(fiveTuple)
+	if err != nil {
+		return 0
+	}
+	backend, ok := g.services.LookupPacket(t, tracking.TCPFlags(tcpFlags))
 	if ok {
 		return copy(output, backend.IP)
 	}
@@ -0,0 +1,258 @@
+package maglev
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"sort"
+
+	"github.com/sipb/spike/common"
+)
+
+// An Export is a Maglev table's backends and lookup table, for
+// inspection and comparison.  It encodes as JSON, and in a compact
+// binary form with MarshalBinary.  Tables with the same size, key and
+// backends have identical exports, so spikes can check that they agree.
+type Export struct {
+	M        uint64          `json:"m"`
+	Backends []ExportBackend `json:"backends"` // ordered by IP address
+
+	// Slots holds the index in Backends of the backend assigned to each
+	// slot, and is empty if there are no backends.
+	Slots []uint32 `json:"slots"`
+}
+
+// An ExportBackend is a backend's weight and permutation parameters.
+type ExportBackend struct {
+	IP     net.IP `json:"ip"`
+	Weight uint   `json:"weight"`
+	Offset uint64 `json:"offset"`
+	Skip   uint64 `json:"skip"`
+}
+
+// The binary form is, in network byte order:
+//
+//	magic     [4]byte "MGLV"
+//	version   uint8   1
+//	m         uint64
+//	nbackends uint32
+//	backends  [nbackends]backend
+//	nslots    uint64, m or 0
+//	slots     [nslots]uint16, or uint32 if nbackends > 65536
+//
+// where each backend is
+//
+//	iplen  uint8, 4 or 16
+//	ip     [iplen]byte
+//	weight uint32
+//	offset uint64
+//	skip   uint64
+const (
+	exportMagic   = "MGLV"
+	exportVersion = 1
+)
+
+var errBadExport = errors.New("malformed table export")
+
+// Export returns the table's backends and lookup table.
+func (t *Table) Export() *Export {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	e := &Export{M: t.m}
+	members := make([]member, 0, len(t.members))
+	for _, m := range t.members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return bytes.Compare(members[i].backend.IP, members[j].backend.IP) < 0
+	})
+	index := make(map[*common.Backend]uint32, len(members))
+	for i, m := range members {
+		index[m.backend] = uint32(i)
+		e.Backends = append(e.Backends, ExportBackend{
+			IP:     append(net.IP(nil), m.backend.IP...),
+			Weight: m.weight,
+			Offset: m.offset,
+			Skip:   m.skip,
+		})
+	}
+	if lookup := t.lookup.Load(); lookup != nil {
+		e.Slots = make([]uint32, len(*lookup))
+		for i, b := range *lookup {
+			e.Slots[i] = index[b]
+		}
+	}
+	return e
+}
+
+// Verify checks that an export is the table that a Maglev table of its
+// size with the given key and its backends computes.  Its size and
+// backends are checked before the table is computed, so that a
+// malformed export cannot make it loop or allocate without bound.
+func (e *Export) Verify(key common.Key) error {
+	if !(&big.Int{}).SetUint64(e.M).ProbablyPrime(0) {
+		return fmt.Errorf("table size %d is not prime", e.M)
+	}
+	if len(e.Backends) == 0 {
+		if len(e.Slots) != 0 {
+			return fmt.Errorf("table has %d slots but no backends",
+				len(e.Slots))
+		}
+		return nil
+	}
+	if uint64(len(e.Slots)) != e.M {
+		return fmt.Errorf("table has %d slots, not %d", len(e.Slots), e.M)
+	}
+
+	t := &Table{m: e.M, key: key}
+	members := make([]member, 0, len(e.Backends))
+	index := make(map[*common.Backend]uint32, len(e.Backends))
+	var prev net.IP
+	for i, eb := range e.Backends {
+		ip := eb.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			return fmt.Errorf("backend %d has bad IP address %v", i, eb.IP)
+		}
+		if i > 0 && bytes.Compare(prev, ip) >= 0 {
+			return fmt.Errorf("backend %v is not after %v in IP order",
+				eb.IP, prev)
+		}
+		prev = ip
+		if eb.Weight > common.MaxWeight {
+			return fmt.Errorf("backend %v has weight %d, more than %d",
+				eb.IP, eb.Weight, common.MaxWeight)
+		}
+		b := &common.Backend{IP: ip}
+		p := t.permutation(b, eb.Weight)
+		if p.offset != eb.Offset || p.skip != eb.Skip {
+			return fmt.Errorf("backend %v has offset %d and skip %d, "+
+				"not %d and %d", eb.IP, eb.Offset, eb.Skip, p.offset, p.skip)
+		}
+		if eb.Weight == 0 {
+			return fmt.Errorf("backend %v has weight 0", eb.IP)
+		}
+		members = append(members, member{b, p})
+		index[b] = uint32(i)
+	}
+
+	lookup := build(e.M, members)
+	for i, b := range lookup {
+		if e.Slots[i] != index[b] {
+			return fmt.Errorf("slot %d is backend %d, not %d",
+				i, e.Slots[i], index[b])
+		}
+	}
+	return nil
+}
+
+// slotWidth returns the size in bytes of a slot in the binary form.
+func (e *Export) slotWidth() int {
+	if len(e.Backends) > 1<<16 {
+		return 4
+	}
+	return 2
+}
+
+// MarshalBinary encodes an export in its binary form.  Weights must fit
+// in 32 bits.
+func (e *Export) MarshalBinary() ([]byte, error) {
+	for _, eb := range e.Backends {
+		if eb.Weight > math.MaxUint32 {
+			return nil, fmt.Errorf("backend %v has weight %d, more than %d",
+				eb.IP, eb.Weight, uint32(math.MaxUint32))
+		}
+	}
+	b := []byte(exportMagic)
+	b = append(b, exportVersion)
+	b = binary.BigEndian.AppendUint64(b, e.M)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(e.Backends)))
+	for _, eb := range e.Backends {
+		ip := eb.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		b = append(b, byte(len(ip)))
+		b = append(b, ip...)
+		b = binary.BigEndian.AppendUint32(b, uint32(eb.Weight))
+		b = binary.BigEndian.AppendUint64(b, eb.Offset)
+		b = binary.BigEndian.AppendUint64(b, eb.Skip)
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(len(e.Slots)))
+	width := e.slotWidth()
+	for _, s := range e.Slots {
+		if width == 2 {
+			b = binary.BigEndian.AppendUint16(b, uint16(s))
+		} else {
+			b = binary.BigEndian.AppendUint32(b, s)
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes an export from its binary form.  It does not
+// verify it.
+func (e *Export) UnmarshalBinary(b []byte) error {
+	if len(b) < len(exportMagic)+1 ||
+		!bytes.Equal(b[:len(exportMagic)], []byte(exportMagic)) {
+		return errors.New("not a table export")
+	}
+	if v := b[len(exportMagic)]; v != exportVersion {
+		return fmt.Errorf("unsupported table export version %d", v)
+	}
+	b = b[len(exportMagic)+1:]
+	if len(b) < 8+4 {
+		return errBadExport
+	}
+	*e = Export{M: binary.BigEndian.Uint64(b)}
+	n := binary.BigEndian.Uint32(b[8:])
+	b = b[12:]
+	for ; n > 0; n-- {
+		if len(b) < 1 {
+			return errBadExport
+		}
+		ipLen := int(b[0])
+		if (ipLen != net.IPv4len && ipLen != net.IPv6len) ||
+			len(b) < 1+ipLen+4+8+8 {
+			return errBadExport
+		}
+		b = b[1:]
+		e.Backends = append(e.Backends, ExportBackend{
+			IP:     append(net.IP(nil), b[:ipLen]...),
+			Weight: uint(binary.BigEndian.Uint32(b[ipLen:])),
+			Offset: binary.BigEndian.Uint64(b[ipLen+4:]),
+			Skip:   binary.BigEndian.Uint64(b[ipLen+12:]),
+		})
+		b = b[ipLen+20:]
+	}
+	if len(b) < 8 {
+		return errBadExport
+	}
+	slots := binary.BigEndian.Uint64(b)
+	b = b[8:]
+	width := e.slotWidth()
+	if slots > uint64(len(b)) || uint64(len(b)) != slots*uint64(width) {
+		return errBadExport
+	}
+	if slots > 0 {
+		e.Slots = make([]uint32, slots)
+	}
+	for i := range e.Slots {
+		if width == 2 {
+			e.Slots[i] = uint32(binary.BigEndian.Uint16(b[2*i:]))
+		} else {
+			e.Slots[i] = binary.BigEndian.Uint32(b[4*i:])
+		}
+		if e.Slots[i] >= uint32(len(e.Backends)) {
+			return errBadExport
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package maglev
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sipb/spike/common"
+)
+
+func exportTable() *Table {
+	backends := []common.Backend{
+		{IP: []byte{10, 0, 0, 1}},
+		{IP: []byte{10, 0, 0, 2}},
+		{IP: net.ParseIP("2001:db8::1")},
+	}
+	table := New(SmallM)
+	table.Update(Config{&backends[0]: 1, &backends[1]: 2, &backends[2]: 1})
+	return table
+}
+
+func TestExport(t *testing.T) {
+	table := exportTable()
+	e := table.Export()
+	require.Len(t, e.Backends, 3)
+	assert.Equal(t, uint64(SmallM), e.M)
+	assert.Equal(t, "10.0.0.1", e.Backends[0].IP.String())
+	assert.Equal(t, uint(2), e.Backends[1].Weight)
+	require.Len(t, e.Slots, SmallM)
+	for i, b := range table.Slots() {
+		require.Equal(t, net.IP(b.IP), e.Backends[e.Slots[i]].IP,
+			"slot %d differs", i)
+	}
+	assert.NoError(t, e.Verify(DefaultKey))
+
+	empty := New(SmallM).Export()
+	assert.Empty(t, empty.Slots)
+	assert.NoError(t, empty.Verify(DefaultKey))
+}
+
+func TestExportEncoding(t *testing.T) {
+	e := exportTable().Export()
+
+	dat, err := json.Marshal(e)
+	require.NoError(t, err)
+	var fromJSON Export
+	require.NoError(t, json.Unmarshal(dat, &fromJSON))
+	assert.NoError(t, fromJSON.Verify(DefaultKey))
+
+	bin, err := e.MarshalBinary()
+	require.NoError(t, err)
+	var fromBinary Export
+	require.NoError(t, fromBinary.UnmarshalBinary(bin))
+	assert.Equal(t, e, &fromBinary)
+	assert.NoError(t, fromBinary.Verify(DefaultKey))
+
+	// the binary forms of identical tables are identical
+	again, err := fromJSON.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, bin, again)
+
+	for i := 0; i < len(bin); i++ {
+		var short Export
+		assert.Error(t, short.UnmarshalBinary(bin[:i]), "truncated to %d", i)
+	}
+	var long Export
+	assert.Error(t, long.UnmarshalBinary(append(bin, 0)))
+}
+
+func TestExportVerify(t *testing.T) {
+	assert.Error(t, exportTable().Export().Verify(common.Key{K0: 1}),
+		"export verified with a different key")
+
+	e := exportTable().Export()
+	e.Slots[100] = (e.Slots[100] + 1) % 3
+	assert.Error(t, e.Verify(DefaultKey), "altered slot not detected")
+
+	e = exportTable().Export()
+	e.Backends[1].Weight = 1
+	assert.Error(t, e.Verify(DefaultKey), "altered weight not detected")
+
+	e = exportTable().Export()
+	e.Backends[0].Skip++
+	assert.Error(t, e.Verify(DefaultKey), "altered skip not detected")
+
+	e = exportTable().Export()
+	e.Slots = e.Slots[1:]
+	assert.Error(t, e.Verify(DefaultKey), "missing slot not detected")
+}
+
+func TestExportVerifyMalformed(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		alter func(e *Export)
+	}{
+		{"non-prime size", func(e *Export) {
+			e.M = SmallM - 2
+			e.Slots = e.Slots[:e.M]
+		}},
+		{"size not the number of slots", func(e *Export) { e.M = BigM }},
+		{"huge size", func(e *Export) { e.M = 1<<61 - 1 }},
+		{"slots without backends", func(e *Export) { e.Backends = nil }},
+		{"unsorted backends", func(e *Export) {
+			e.Backends[0], e.Backends[1] = e.Backends[1], e.Backends[0]
+		}},
+		{"duplicate backends", func(e *Export) {
+			e.Backends[1].IP = e.Backends[0].IP
+		}},
+		{"bad IP address", func(e *Export) {
+			e.Backends[0].IP = net.IP{10, 0, 1}
+		}},
+		{"weight too big", func(e *Export) {
+			e.Backends[0].Weight = common.MaxWeight + 1
+		}},
+	} {
+		e := exportTable().Export()
+		test.alter(e)
+		assert.Error(t, e.Verify(DefaultKey), test.name)
+	}
+
+	e := New(SmallM).Export()
+	e.M = 4
+	assert.Error(t, e.Verify(DefaultKey), "non-prime empty table size")
+}
+
+func TestExportWeight(t *testing.T) {
+	e := exportTable().Export()
+	e.Backends[0].Weight = math.MaxUint32 + 1
+	_, err := e.MarshalBinary()
+	assert.Error(t, err)
+	e.Backends[0].Weight = math.MaxUint32
+	_, err = e.MarshalBinary()
+	assert.NoError(t, err)
+}
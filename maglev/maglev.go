@@ -1,12 +1,25 @@
 // Package maglev implements maglev consistent hashing.
 //
 // http://research.google.com/pubs/pub44824.html
+//
+// A backend's offset and skip are the siphashes of its IP address under
+// the two halves of the table's key, K0 and K1, each extended with
+// zeros, so that DefaultKey gives backends the positions they have
+// always had.  Backends take turns to fill the
+// table in order of their offsets, and of their IP addresses' bytes
+// when offsets are equal, so all tables with the same size, key, and
+// backend configuration (IP addresses and weights) are identical
+// however they were built.  Every spike in a fleet should therefore use
+// the same key.
 package maglev
 
 import (
+	"bytes"
+	"fmt"
 	"math/big"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/dchest/siphash"
 
@@ -19,10 +32,9 @@ const (
 	BigM   = 655373
 )
 
-const (
-	offsetKey = uint64(0x35d53c5371bdf886)
-	skipKey   = uint64(0x9e1dbc702649df3a)
-)
+// DefaultKey is the key used by New.  It is public, so production
+// deployments should configure their own key.
+var DefaultKey = common.Key{K0: 0x35d53c5371bdf886, K1: 0x9e1dbc702649df3a}
 
 type permutation struct {
 	weight uint
@@ -30,138 +42,296 @@ type permutation struct {
 	skip   uint64
 }
 
-// Table represents a Maglev hashing table.
+// A member is a backend in the table.
+type member struct {
+	backend *common.Backend
+	permutation
+}
+
+// Table represents a Maglev hashing table.  Lookup does not lock: each
+// change builds a new lookup table, which replaces the old one
+// atomically, so lookups are never stalled by a rebuild.
+//
+// Backends are identified by their IDs (see common.Backend.Identity),
+// so a backend which comes up again with a new *common.Backend replaces
+// the old one rather than being added alongside it.  No two backends in
+// a table may share an IP address, as they would share slots too.
 type Table struct {
-	m            uint64 // size of the lookup table
-	permutations map[*common.Backend]permutation
-	lookup       []*common.Backend
-	mutex        sync.RWMutex
+	m      uint64                            // size of the lookup table
+	lookup atomic.Pointer[[]*common.Backend] // nil if there are no backends
+
+	// mutex serializes changes.
+	mutex   sync.Mutex
+	key     common.Key
+	members map[string]member // keyed by ID
 }
 
-// New returns a new Maglev table with the specified size.
+// New returns a new Maglev table with the specified size, using
+// DefaultKey.
 func New(m uint64) *Table {
+	return NewWithKey(m, DefaultKey)
+}
+
+// NewWithKey returns a new Maglev table with the specified size and
+// key.
+func NewWithKey(m uint64, key common.Key) *Table {
 	if !(&big.Int{}).SetUint64(m).ProbablyPrime(0) {
 		panic("m is not prime")
 	}
 	return &Table{
-		m:            m,
-		permutations: make(map[*common.Backend]permutation),
+		m:       m,
+		key:     key,
+		members: make(map[string]member),
 	}
 }
 
+func (t *Table) permutation(backend *common.Backend, weight uint) permutation {
+	return permutation{
+		weight: weight,
+		offset: siphash.Hash(t.key.K0, 0, backend.IP) % t.m,
+		skip:   siphash.Hash(t.key.K1, 0, backend.IP)%(t.m-1) + 1,
+	}
+}
+
+// Key returns the table's key.
+func (t *Table) Key() common.Key {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.key
+}
+
+// SetKey changes the table's key.  Almost every backend will move to a
+// different set of slots, so most connections that are not tracked
+// will be sent to a different backend.
+func (t *Table) SetKey(key common.Key) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.key = key
+	for id, m := range t.members {
+		m.permutation = t.permutation(m.backend, m.weight)
+		t.members[id] = m
+	}
+	t.populate()
+}
+
 // A Config is a mapping from backends to weights.
 type Config map[*common.Backend]uint
 
 // Reconfig reconfigures the table with the given backend weight
-// configuration.
-func (t *Table) Reconfig(c Config) {
+// configuration.  It returns an error, and leaves the table unchanged,
+// if two backends in c have the same ID or IP address.
+func (t *Table) Reconfig(c Config) error {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
+	return t.apply(make(map[string]member), c)
+}
 
-	t.permutations = make(map[*common.Backend]permutation)
-	for b, w := range c {
+// SetWeight sets the weight of the given backend to weight, adding it
+// to the table if necessary, or replacing the backend with the same
+// ID.  It returns an error if another backend has the same IP address.
+func (t *Table) SetWeight(backend *common.Backend, weight uint) error {
+	if backend == nil {
+		panic("backend is nil")
+	}
+	return t.Update(Config{backend: weight})
+}
+
+// Update sets the weights of the backends in c as SetWeight does, and
+// removes those with weight 0.  Backends not in c are unchanged.  The
+// lookup table is rebuilt once, so many changes are cheaper to make
+// with one Update than one at a time.  If any change fails, none is
+// made.
+func (t *Table) Update(c Config) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	members := make(map[string]member, len(t.members)+len(c))
+	for id, m := range t.members {
+		members[id] = m
+	}
+	return t.apply(members, c)
+}
+
+// apply makes the changes in c to members and, if they are valid,
+// makes members the table's backends.  t.mutex must be held.
+func (t *Table) apply(members map[string]member, c Config) error {
+	seen := make(map[string]bool, len(c))
+	for b := range c {
 		if b == nil {
 			panic("nil backend in config")
 		}
+		id := b.Identity()
+		if seen[id] {
+			return fmt.Errorf("duplicate backend %q", id)
+		}
+		seen[id] = true
+		// removals first, so that a backend can take the IP address of
+		// one removed in the same change
+		if c[b] == 0 {
+			delete(members, id)
+		}
+	}
+	for b, w := range c {
 		if w == 0 {
 			continue
 		}
-		t.permutations[b] = permutation{
-			weight: w,
-			offset: siphash.Hash(offsetKey, 0, []byte(b.IP)) % t.m,
-			skip:   siphash.Hash(skipKey, 0, []byte(b.IP))%(t.m-1) + 1,
+		if w > common.MaxWeight {
+			return fmt.Errorf("backend %q has weight %d, more than %d",
+				b.Identity(), w, common.MaxWeight)
+		}
+		if err := t.set(members, b, w); err != nil {
+			return err
 		}
 	}
+	t.members = members
 	t.populate()
+	return nil
 }
 
-// SetWeight sets the weight of the given backend to weight, adding it
-// to the table if necessary.
-func (t *Table) SetWeight(backend *common.Backend, weight uint) {
+// set sets the weight of a non-zero weight backend in members.
+func (t *Table) set(members map[string]member, backend *common.Backend, weight uint) error {
+	id := backend.Identity()
+	for other, m := range members {
+		if other != id && bytes.Equal(m.backend.IP, backend.IP) {
+			return fmt.Errorf("backends %q and %q have the same IP address",
+				other, id)
+		}
+	}
+	m, ok := members[id]
+	if ok && bytes.Equal(m.backend.IP, backend.IP) {
+		m.backend = backend
+		m.weight = weight
+	} else {
+		m = member{backend, t.permutation(backend, weight)}
+	}
+	members[id] = m
+	return nil
+}
+
+// SetWeightByID sets the weight of the backend with the given ID, and
+// removes it if weight is 0.  It returns false if there is no such
+// backend, or weight is more than common.MaxWeight.
+func (t *Table) SetWeightByID(id string, weight uint) bool {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	if backend == nil {
-		panic("backend is nil")
+	m, ok := t.members[id]
+	if !ok || weight > common.MaxWeight {
+		return false
 	}
-
 	if weight == 0 {
-		delete(t.permutations, backend)
-		t.populate()
-		return
-	}
-
-	p, ok := t.permutations[backend]
-	if ok {
-		p.weight = weight
-		t.permutations[backend] = p
+		delete(t.members, id)
 	} else {
-		t.permutations[backend] = permutation{
-			weight: weight,
-			offset: siphash.Hash(offsetKey, 0, []byte(backend.IP)) % t.m,
-			skip:   siphash.Hash(skipKey, 0, []byte(backend.IP))%(t.m-1) + 1,
-		}
+		m.weight = weight
+		t.members[id] = m
 	}
 	t.populate()
+	return true
+}
+
+// Backend returns the backend with the given ID and its weight, or
+// false if there is no such backend.
+func (t *Table) Backend(id string) (*common.Backend, uint, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	m, ok := t.members[id]
+	return m.backend, m.weight, ok
+}
+
+// Backends returns the backends in the table, ordered by IP address.
+func (t *Table) Backends() []*common.Backend {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	backends := make([]*common.Backend, 0, len(t.members))
+	for _, m := range t.members {
+		backends = append(backends, m.backend)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return bytes.Compare(backends[i].IP, backends[j].IP) < 0
+	})
+	return backends
 }
 
 // Add adds a backend to the table with weight 1.
-func (t *Table) Add(backend *common.Backend) {
-	t.SetWeight(backend, 1)
+func (t *Table) Add(backend *common.Backend) error {
+	return t.SetWeight(backend, 1)
 }
 
-// Remove removes a backend from the table.
+// Remove removes a backend from the table.  It does nothing if the
+// backend has been replaced by another with the same ID, so that a
+// stale removal does not remove its replacement; SetWeightByID removes
+// a backend by ID.
 func (t *Table) Remove(backend *common.Backend) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
-	delete(t.permutations, backend)
-	t.populate()
+	if backend == nil {
+		return
+	}
+	id := backend.Identity()
+	if m, ok := t.members[id]; ok && m.backend == backend {
+		delete(t.members, id)
+		t.populate()
+	}
 }
 
 // Lookup looks up a key in the table and returns the associated
 // backend, or false if there are no backends.
 func (t *Table) Lookup(key uint64) (*common.Backend, bool) {
-	t.mutex.RLock()
-	defer t.mutex.RUnlock()
-
-	if t.lookup == nil {
+	lookup := t.lookup.Load()
+	if lookup == nil {
 		return nil, false
 	}
-	return t.lookup[key%t.m], true
+	return (*lookup)[key%t.m], true
 }
 
+// populate builds a new lookup table from t.members and replaces the
+// current one.  t.mutex must be held.
 func (t *Table) populate() {
+	members := make([]member, 0, len(t.members))
+	for _, m := range t.members {
+		members = append(members, m)
+	}
+	entry := build(t.m, members)
+	if entry == nil {
+		t.lookup.Store(nil)
+		return
+	}
+	t.lookup.Store(&entry)
+}
+
+// build returns the lookup table of size m for the given members, or
+// nil if they all have weight 0.
+func build(m uint64, members []member) []*common.Backend {
 	nonzero := false
-	for _, p := range t.permutations {
-		if p.weight > 0 {
+	for _, b := range members {
+		if b.weight > 0 {
 			nonzero = true
 			break
 		}
 	}
 	if !nonzero {
-		t.lookup = nil
-		return
+		return nil
 	}
 
 	type bstate struct {
-		backend *common.Backend
-		loc     uint64
-		permutation
+		loc uint64
+		member
 	}
 
-	state := make([]bstate, 0, len(t.permutations))
-	for b, p := range t.permutations {
-		state = append(state, bstate{b, p.offset, p})
+	state := make([]bstate, 0, len(members))
+	for _, b := range members {
+		state = append(state, bstate{b.offset, b})
 	}
 	// sort state to guarantee consistency given identical configurations
 	sort.Slice(state, func(i, j int) bool {
-		return state[i].offset < state[j].offset
+		if state[i].offset != state[j].offset {
+			return state[i].offset < state[j].offset
+		}
+		return bytes.Compare(state[i].backend.IP, state[j].backend.IP) < 0
 	})
 
-	entry := make([]*common.Backend, t.m)
-	for j := range entry {
-		entry[j] = nil
-	}
+	entry := make([]*common.Backend, m)
 
 	var inserted uint64
 	for {
@@ -170,21 +340,20 @@ func (t *Table) populate() {
 				c := s.loc
 				for entry[c] != nil {
 					c += s.skip
-					if c >= t.m {
-						c -= t.m
+					if c >= m {
+						c -= m
 					}
 				}
 				entry[c] = s.backend
 				c += s.skip
-				if c >= t.m {
-					c -= t.m
+				if c >= m {
+					c -= m
 				}
 				state[i].loc = c
 
 				inserted++
-				if inserted == t.m {
-					t.lookup = entry
-					return
+				if inserted == m {
+					return entry
 				}
 			}
 		}
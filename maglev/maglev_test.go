@@ -2,8 +2,10 @@ package maglev
 
 import (
 	"math/rand"
+	"net"
 	"testing"
 
+	"github.com/dchest/siphash"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -171,8 +173,8 @@ func TestDistribution(t *testing.T) {
 	table.Reconfig(config)
 
 	freq := make(map[*common.Backend]int64)
-	for i := 0; i < len(table.lookup); i++ {
-		freq[table.lookup[i]]++
+	for _, b := range *table.lookup.Load() {
+		freq[b]++
 	}
 
 	assert.Equal(t, len(backends), len(freq), "There should be %d backends.", len(backends))
@@ -184,3 +186,306 @@ func TestDistribution(t *testing.T) {
 			"Number of occurrences of backend %d is outside tolerance of 10%%.", i)
 	}
 }
+
+func TestKey(t *testing.T) {
+	backends := make([]common.Backend, 10)
+	config := make(Config)
+	for i := 0; i < len(backends); i++ {
+		backends[i] = common.Backend{IP: []byte{10, 0, 0, byte(i)}}
+		config[&backends[i]] = 1
+	}
+	key := common.Key{K0: 1, K1: 2}
+
+	a := NewWithKey(SmallM, key)
+	a.Reconfig(config)
+	b := New(SmallM)
+	b.Reconfig(config)
+	assert.NotEqual(t, *a.lookup.Load(), *b.lookup.Load(),
+		"tables with different keys are identical")
+
+	b.SetKey(key)
+	assert.Equal(t, key, b.Key())
+	assert.Equal(t, *a.lookup.Load(), *b.lookup.Load(),
+		"tables with the same key and backends differ")
+}
+
+func TestDefaultKeyPermutation(t *testing.T) {
+	// the offsets and skips of earlier versions, which had no key
+	const offsetKey, skipKey = 0x35d53c5371bdf886, 0x9e1dbc702649df3a
+	table := New(SmallM)
+	for _, ip := range [][]byte{{10, 0, 0, 1}, net.ParseIP("2001:db8::1")} {
+		p := table.permutation(&common.Backend{IP: ip}, 1)
+		assert.Equal(t, siphash.Hash(offsetKey, 0, ip)%SmallM, p.offset)
+		assert.Equal(t, siphash.Hash(skipKey, 0, ip)%(SmallM-1)+1, p.skip)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	backends := make([]common.Backend, 6)
+	for i := 0; i < len(backends); i++ {
+		backends[i] = common.Backend{IP: []byte{10, 0, 0, byte(i)}}
+	}
+
+	// the same changes, one at a time and in one batch
+	a := New(SmallM)
+	b := New(SmallM)
+	for i := 0; i < 4; i++ {
+		a.Add(&backends[i])
+	}
+	b.Update(Config{&backends[0]: 1, &backends[1]: 1, &backends[2]: 1,
+		&backends[3]: 1})
+	assert.Equal(t, *a.lookup.Load(), *b.lookup.Load())
+
+	a.Remove(&backends[0])
+	a.SetWeight(&backends[1], 3)
+	a.Add(&backends[4])
+	a.Add(&backends[5])
+	b.Update(Config{&backends[0]: 0, &backends[1]: 3, &backends[4]: 1,
+		&backends[5]: 1})
+	assert.Equal(t, *a.lookup.Load(), *b.lookup.Load(),
+		"batched and individual updates differ")
+
+	b.Update(Config{&backends[1]: 0, &backends[2]: 0, &backends[3]: 0,
+		&backends[4]: 0, &backends[5]: 0})
+	_, ok := b.Lookup(0)
+	assert.False(t, ok, "lookup succeeded with no backends")
+
+	assert.Panics(t, func() { b.Update(Config{nil: 1}) },
+		"Update should panic for nil entries in config")
+}
+
+func TestConcurrentLookup(t *testing.T) {
+	backends := make([]common.Backend, 10)
+	for i := 0; i < len(backends); i++ {
+		backends[i] = common.Backend{IP: []byte{10, 0, 0, byte(i)}}
+	}
+	table := New(SmallM)
+	table.Add(&backends[0])
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			b := &backends[1+i%(len(backends)-1)]
+			table.Add(b)
+			table.Remove(b)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		_, ok := table.Lookup(rand.Uint64())
+		require.True(t, ok, "lookup failed during rebuild")
+	}
+}
+
+func benchmarkBackends(n int) []common.Backend {
+	backends := make([]common.Backend, n)
+	for i := 0; i < n; i++ {
+		backends[i] = common.Backend{IP: []byte{10, 0, byte(i >> 8), byte(i)}}
+	}
+	return backends
+}
+
+func benchmarkPopulate(b *testing.B, m uint64, n int) {
+	backends := benchmarkBackends(n)
+	config := make(Config)
+	for i := range backends {
+		config[&backends[i]] = 1
+	}
+	table := New(m)
+	table.Reconfig(config)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.mutex.Lock()
+		table.populate()
+		table.mutex.Unlock()
+	}
+}
+
+func BenchmarkPopulateSmallM10(b *testing.B)  { benchmarkPopulate(b, SmallM, 10) }
+func BenchmarkPopulateSmallM100(b *testing.B) { benchmarkPopulate(b, SmallM, 100) }
+func BenchmarkPopulateBigM100(b *testing.B)   { benchmarkPopulate(b, BigM, 100) }
+func BenchmarkPopulateBigM1000(b *testing.B)  { benchmarkPopulate(b, BigM, 1000) }
+
+// BenchmarkFlap measures a backend going down and up again.
+func BenchmarkFlap(b *testing.B) {
+	backends := benchmarkBackends(100)
+	table := New(BigM)
+	for i := range backends {
+		table.Add(&backends[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Remove(&backends[0])
+		table.Add(&backends[0])
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	backends := benchmarkBackends(100)
+	table := New(BigM)
+	for i := range backends {
+		table.Add(&backends[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Lookup(uint64(i) * 0x9e3779b97f4a7c15)
+	}
+}
+
+// BenchmarkLookupParallel measures lookups on every CPU while a backend
+// flaps.
+func BenchmarkLookupParallel(b *testing.B) {
+	backends := benchmarkBackends(100)
+	table := New(BigM)
+	for i := range backends {
+		table.Add(&backends[i])
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			table.Remove(&backends[0])
+			table.Add(&backends[0])
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		k := rand.Uint64()
+		for pb.Next() {
+			table.Lookup(k)
+			k += 0x9e3779b97f4a7c15
+		}
+	})
+}
+
+// TestDeterministic checks that tables with the same configuration are
+// identical however they were built, even when backends share offsets.
+func TestDeterministic(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	for trial := 0; trial < 50; trial++ {
+		// small tables make shared offsets likely
+		m := []uint64{13, 101, SmallM}[trial%3]
+		n := 1 + r.Intn(30)
+		weights := make([]uint, n)
+		for i := range weights {
+			weights[i] = uint(1 + r.Intn(3))
+		}
+		ip := func(i int) []byte { return []byte{10, 0, 0, byte(i)} }
+
+		config := make(Config)
+		for i := 0; i < n; i++ {
+			config[&common.Backend{IP: ip(i)}] = weights[i]
+		}
+		want := New(m)
+		want.Reconfig(config)
+
+		for shuffle := 0; shuffle < 5; shuffle++ {
+			table := New(m)
+			backends := make([]*common.Backend, n)
+			for i := range backends {
+				backends[i] = &common.Backend{IP: ip(i)}
+			}
+			for _, i := range r.Perm(n) {
+				switch r.Intn(3) {
+				case 0:
+					table.SetWeight(backends[i], weights[i])
+				case 1:
+					// add it, take it out, and put it back
+					table.Add(backends[i])
+					table.Remove(backends[i])
+					table.SetWeight(backends[i], weights[i])
+				default:
+					table.Update(Config{backends[i]: weights[i]})
+				}
+			}
+			require.Equal(t, want.Export(), table.Export(),
+				"tables differ: m %d, weights %v", m, weights)
+		}
+	}
+}
+
+// TestSharedOffset checks the order of backends which share an offset.
+func TestSharedOffset(t *testing.T) {
+	const m = 13
+	table := New(m)
+	byOffset := make(map[uint64][]*common.Backend)
+	for i := 0; i < 2*m; i++ {
+		b := &common.Backend{IP: []byte{10, 0, 0, byte(i)}}
+		offset := table.permutation(b, 1).offset
+		byOffset[offset] = append(byOffset[offset], b)
+	}
+	for offset, backends := range byOffset {
+		if len(backends) < 2 {
+			continue
+		}
+		// the backend with the lower IP address takes its offset
+		a, b := backends[0], backends[1]
+		table.Reconfig(Config{b: 1, a: 1})
+		got, _ := table.Lookup(offset)
+		assert.Equal(t, a, got, "lower IP does not take shared offset")
+		return
+	}
+	t.Fatal("no backends share an offset")
+}
+
+func TestIdentity(t *testing.T) {
+	table := New(SmallM)
+	a := &common.Backend{IP: []byte{10, 0, 0, 1}, ID: "a"}
+	b := &common.Backend{IP: []byte{10, 0, 0, 2}, ID: "b"}
+	require.NoError(t, table.Add(a))
+	require.NoError(t, table.Add(b))
+	before := table.Export()
+
+	// a comes up again as a new Backend, replacing the old one
+	a2 := &common.Backend{IP: []byte{10, 0, 0, 1}, ID: "a"}
+	require.NoError(t, table.Add(a2))
+	assert.Equal(t, before, table.Export(), "replacing a backend moved slots")
+	got, weight, ok := table.Backend("a")
+	require.True(t, ok)
+	assert.Same(t, a2, got)
+	assert.Equal(t, uint(1), weight)
+	for _, s := range table.Slots() {
+		require.NotSame(t, a, s, "replaced backend still in table")
+	}
+
+	// removing the old Backend does not remove its replacement
+	table.Remove(a)
+	_, _, ok = table.Backend("a")
+	assert.True(t, ok, "stale removal removed replacement")
+
+	// backends with the same IP address, or the same ID, are rejected
+	c := &common.Backend{IP: []byte{10, 0, 0, 2}, ID: "c"}
+	assert.Error(t, table.Add(c))
+	b2 := &common.Backend{IP: []byte{10, 0, 0, 3}, ID: "b"}
+	assert.Error(t, table.Update(Config{b: 2, b2: 1}))
+	assert.Error(t, table.Reconfig(Config{a: 1, c: 1, b: 1}))
+	assert.Equal(t, before, table.Export(), "rejected change was made")
+
+	// unless the other backend is removed at the same time
+	assert.NoError(t, table.Update(Config{b: 0, c: 1}))
+	_, _, ok = table.Backend("b")
+	assert.False(t, ok)
+
+	// weights can be changed by ID
+	assert.True(t, table.SetWeightByID("c", 3))
+	_, weight, _ = table.Backend("c")
+	assert.Equal(t, uint(3), weight)
+	assert.False(t, table.SetWeightByID("b", 1))
+	assert.True(t, table.SetWeightByID("c", 0))
+	assert.True(t, table.SetWeightByID("a", 0))
+	_, ok = table.Lookup(0)
+	assert.False(t, ok, "lookup succeeded with no backends")
+
+	// a backend without an ID is identified by its IP address
+	assert.Equal(t, "10.0.0.4", (&common.Backend{IP: []byte{10, 0, 0, 4}}).Identity())
+}
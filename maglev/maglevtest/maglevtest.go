@@ -0,0 +1,36 @@
+// Package maglevtest provides assertions of the properties the Maglev
+// paper finds of Maglev tables, for tests of code which uses them.
+package maglevtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/maglev"
+)
+
+// AssertDisruption checks that at most max of the slots of two lookup
+// tables (see maglev.Table.Slots) differ.
+func AssertDisruption(t testing.TB, before, after []*common.Backend,
+	max float64) bool {
+	t.Helper()
+	d := maglev.Disruption(before, after)
+	return assert.LessOrEqual(t, d, max,
+		"%.4f of slots moved, more than %.4f", d, max)
+}
+
+// AssertBalanced checks that every backend has its ideal share of the
+// table to within one round of population, which is as balanced as
+// Maglev tables are.
+func AssertBalanced(t testing.TB, table *maglev.Table) bool {
+	t.Helper()
+	ok := true
+	for _, s := range table.Balance() {
+		ok = assert.InDelta(t, s.Ideal, float64(s.Slots), float64(s.Weight),
+			"backend %v has %d slots, ideally %.1f",
+			s.Backend.IP, s.Slots, s.Ideal) && ok
+	}
+	return ok
+}
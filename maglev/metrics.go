@@ -0,0 +1,83 @@
+package maglev
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/sipb/spike/common"
+)
+
+// Slots returns the table's current lookup table, with the backend
+// assigned to each slot, or nil if there are no backends.  It is shared
+// with the table and must not be modified, but it does not change when
+// the table does, so it can be compared with a later one.
+func (t *Table) Slots() []*common.Backend {
+	lookup := t.lookup.Load()
+	if lookup == nil {
+		return nil
+	}
+	return *lookup
+}
+
+// Disruption returns the fraction of slots assigned to a different
+// backend in two lookup tables of the same size, as returned by Slots.
+// Backends are compared by ID, so a backend which went down and came up
+// again counts as the same backend.  An empty table differs from a
+// non-empty one in every slot.
+func Disruption(a, b []*common.Backend) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return 1
+	}
+	if len(a) != len(b) {
+		panic("tables differ in size")
+	}
+	changed := 0
+	for i := range a {
+		if a[i] != b[i] && a[i].Identity() != b[i].Identity() {
+			changed++
+		}
+	}
+	return float64(changed) / float64(len(a))
+}
+
+// A Share is the number of slots assigned to a backend, and the number
+// its weight entitles it to.
+type Share struct {
+	Backend *common.Backend
+	Weight  uint
+	Slots   int
+	Ideal   float64
+}
+
+// Balance returns the share of the table of each backend, ordered by IP
+// address.
+func (t *Table) Balance() []Share {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var total uint
+	for _, m := range t.members {
+		total += m.weight
+	}
+	counts := make(map[*common.Backend]int)
+	for _, b := range t.Slots() {
+		counts[b]++
+	}
+
+	shares := make([]Share, 0, len(t.members))
+	for _, m := range t.members {
+		shares = append(shares, Share{
+			Backend: m.backend,
+			Weight:  m.weight,
+			Slots:   counts[m.backend],
+			Ideal:   float64(t.m) * float64(m.weight) / float64(total),
+		})
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return bytes.Compare(shares[i].Backend.IP, shares[j].Backend.IP) < 0
+	})
+	return shares
+}
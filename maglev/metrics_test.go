@@ -0,0 +1,88 @@
+package maglev_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/maglev"
+	"github.com/sipb/spike/maglev/maglevtest"
+)
+
+func metricsBackends(n int) []common.Backend {
+	backends := make([]common.Backend, n)
+	for i := range backends {
+		backends[i] = common.Backend{IP: []byte{10, 0, byte(i >> 8), byte(i)}}
+	}
+	return backends
+}
+
+func TestDisruption(t *testing.T) {
+	backends := metricsBackends(3)
+	a := []*common.Backend{&backends[0], &backends[1], &backends[0], &backends[2]}
+	b := []*common.Backend{&backends[0], &backends[2], &backends[0], &backends[2]}
+	assert.Equal(t, 0.25, maglev.Disruption(a, b))
+	assert.Equal(t, 0.0, maglev.Disruption(a, a))
+	assert.Equal(t, 1.0, maglev.Disruption(a, nil))
+	assert.Equal(t, 0.0, maglev.Disruption(nil, nil))
+
+	// a backend which comes up again is the same backend
+	again := common.Backend{IP: backends[1].IP}
+	c := []*common.Backend{&backends[0], &again, &backends[0], &backends[2]}
+	assert.Equal(t, 0.0, maglev.Disruption(a, c))
+
+	assert.Panics(t, func() { maglev.Disruption(a, b[:3]) },
+		"Disruption should panic for tables of different sizes")
+}
+
+func TestBalance(t *testing.T) {
+	backends := metricsBackends(3)
+	table := maglev.New(maglev.SmallM)
+	assert.Empty(t, table.Balance())
+
+	table.Update(maglev.Config{
+		&backends[2]: 1, &backends[0]: 2, &backends[1]: 1,
+	})
+	shares := table.Balance()
+	require.Len(t, shares, 3)
+	total := 0
+	for i, s := range shares {
+		assert.Equal(t, &backends[i], s.Backend, "shares are not in order")
+		total += s.Slots
+	}
+	assert.Equal(t, maglev.SmallM, total)
+	assert.Equal(t, uint(2), shares[0].Weight)
+	assert.InDelta(t, maglev.SmallM/2.0, shares[0].Ideal, 1e-6)
+	maglevtest.AssertBalanced(t, table)
+}
+
+// TestMinimalDisruption checks that adding or removing one of n equally
+// weighted backends moves little more than the 1/n of slots which must
+// move, as the Maglev paper finds for tables much larger than n.
+func TestMinimalDisruption(t *testing.T) {
+	for _, n := range []int{5, 10, 100} {
+		backends := metricsBackends(n + 1)
+		config := make(maglev.Config)
+		for i := 0; i < n; i++ {
+			config[&backends[i]] = 1
+		}
+		table := maglev.New(maglev.SmallM)
+		table.Reconfig(config)
+		maglevtest.AssertBalanced(t, table)
+
+		before := table.Slots()
+		table.Remove(&backends[0])
+		maglevtest.AssertDisruption(t, before, table.Slots(), 2/float64(n))
+		maglevtest.AssertBalanced(t, table)
+
+		table.Add(&backends[0])
+		assert.Equal(t, before, table.Slots(),
+			"table differs after removing and adding a backend")
+
+		table.Add(&backends[n])
+		maglevtest.AssertDisruption(t, before, table.Slots(), 2/float64(n+1))
+		maglevtest.AssertBalanced(t, table)
+	}
+}
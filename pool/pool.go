@@ -0,0 +1,620 @@
+// Package pool manages pools of health-checked backends, and chooses
+// between them using a balancer, Maglev hashing by default, and
+// connection tracking.
+package pool
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sipb/spike/balancer"
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/config"
+	"github.com/sipb/spike/health"
+	"github.com/sipb/spike/maglev"
+	"github.com/sipb/spike/tracking"
+)
+
+const (
+	pollDelay     = time.Second
+	httpTimeout   = 2 * time.Second
+	healthFall    = 5       // failed checks before a backend goes down
+	healthJitter  = 0.1     // of pollDelay
+	trackMax      = 1 << 20 // connections tracked per pool
+	sweepInterval = time.Minute
+)
+
+// defaultTimeouts are the connection-tracking timeouts used for those
+// not set in the configuration.
+var defaultTimeouts = tracking.Timeouts{
+	TCPSyn:         time.Minute,
+	TCPEstablished: 15 * time.Minute,
+	TCPClosing:     2 * time.Minute,
+	UDP:            5 * time.Minute,
+	Other:          15 * time.Minute,
+}
+
+// timeouts returns the connection-tracking timeouts of a validated
+// configuration.
+func timeouts(cfg config.Timeouts) tracking.Timeouts {
+	t := defaultTimeouts
+	for _, d := range []struct {
+		to   *time.Duration
+		from time.Duration
+	}{
+		{&t.TCPSyn, cfg.TCPSyn},
+		{&t.TCPEstablished, cfg.TCPEstablished},
+		{&t.TCPClosing, cfg.TCPClosing},
+		{&t.UDP, cfg.UDP},
+	} {
+		if d.from != 0 {
+			*d.to = d.from
+		}
+	}
+	return t
+}
+
+type backendInfo struct {
+	cfg config.Backend
+
+	// checker health checks the backend; its check and options change
+	// when the backend is reconfigured.
+	checker *health.Checker
+
+	quit chan<- struct{}
+
+	// current is the backend while it is healthy, and nil otherwise.
+	current *common.Backend
+
+	// drain is non-nil while the backend is draining: it receives no
+	// new connections, and is removed when drain fires, at drainEnd.
+	drain    *time.Timer
+	drainEnd time.Time
+}
+
+// Pool is a set of health-checked backends, together with the balancer
+// and connection-tracking table that choose between them.  Pool is
+// thread-safe.
+type Pool struct {
+	balancer  atomic.Pointer[balancer.Balancer]
+	tracker   *tracking.Cache
+	lookupKey atomic.Pointer[common.Key]
+	onHealth  atomic.Value // func(address string, healthy bool)
+
+	quit      chan struct{} // stops the tracker's sweeper
+	closeOnce sync.Once
+
+	mutex     sync.Mutex
+	backends  map[string]*backendInfo // keyed by address
+	algorithm string                  // a config.Balancer name
+	key       common.Key              // the balancer's key
+
+	// restored is the state of the pool's backends from a snapshot,
+	// keyed by address, until they are added.
+	restored map[string]backendSnapshot
+
+	// batch collects balancer weight changes during Reconfigure, so
+	// that a Maglev table is rebuilt once.
+	batch balancer.Config
+}
+
+// New constructs an empty pool using the given hash keys, which uses
+// Maglev hashing.
+func New(lookupKey, maglevKey common.Key) *Pool {
+	p := &Pool{
+		quit:      make(chan struct{}),
+		backends:  make(map[string]*backendInfo),
+		algorithm: config.BalancerMaglev,
+		key:       maglevKey,
+	}
+	p.lookupKey.Store(&lookupKey)
+	b := newBalancer(p.algorithm, p.key)
+	p.balancer.Store(&b)
+	p.tracker = tracking.NewWithLimit(func(key uint64) (*common.Backend, bool) {
+		return (*p.balancer.Load()).Lookup(key)
+	}, defaultTimeouts, trackMax)
+	p.tracker.SweepEvery(sweepInterval, p.quit)
+	return p
+}
+
+// newBalancer returns an empty balancer of a validated kind.
+func newBalancer(algorithm string, key common.Key) balancer.Balancer {
+	switch algorithm {
+	case config.BalancerRendezvous:
+		return balancer.NewRendezvous(key)
+	case config.BalancerJump:
+		return balancer.NewJump()
+	case config.BalancerRing:
+		return balancer.NewRing(key)
+	case config.BalancerRoundRobin:
+		return balancer.NewRoundRobin()
+	default:
+		return maglev.NewWithKey(maglev.SmallM, key)
+	}
+}
+
+// setKeys changes the pool's hash keys.  The balancer is only rebuilt
+// if its key changes.
+func (p *Pool) setKeys(lookupKey, maglevKey common.Key) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.lookupKey.Store(&lookupKey)
+	if maglevKey != p.key {
+		p.key = maglevKey
+		p.Balancer().SetKey(maglevKey)
+	}
+}
+
+// Balancer returns the balancer which chooses the backends of new
+// connections.  It is replaced by SetBalancer.
+func (p *Pool) Balancer() balancer.Balancer {
+	return *p.balancer.Load()
+}
+
+// SetBalancer changes the algorithm which chooses the backends of new
+// connections to the one with the given config.Balancer name, which
+// must be valid; the empty name is Maglev.  Tracked connections keep
+// their backends.
+func (p *Pool) SetBalancer(algorithm string) {
+	if algorithm == "" {
+		algorithm = config.BalancerMaglev
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if algorithm == p.algorithm {
+		return
+	}
+	b := newBalancer(algorithm, p.key)
+	c := make(balancer.Config)
+	for _, info := range p.backends {
+		if info.current != nil && info.drain == nil {
+			c[info.current] = info.cfg.Weight
+		}
+	}
+	if err := b.Update(c); err != nil {
+		log.Printf("Cannot change balancer: %v", err)
+		return
+	}
+	p.algorithm = algorithm
+	p.balancer.Store(&b)
+}
+
+// OnHealthChange arranges for f to be called with a backend's address
+// whenever its health check brings it up or takes it down, for example
+// to log it.  Backends restored from a snapshot start healthy without
+// f being called.  f is called with a lock held, so it must not block
+// or use the pool.
+func (p *Pool) OnHealthChange(f func(address string, healthy bool)) {
+	p.onHealth.Store(f)
+}
+
+func (p *Pool) healthChanged(address string, healthy bool) {
+	if f, ok := p.onHealth.Load().(func(string, bool)); ok && f != nil {
+		f(address, healthy)
+	}
+}
+
+// SetTimeouts changes the connection-tracking timeouts.
+func (p *Pool) SetTimeouts(t tracking.Timeouts) {
+	p.tracker.SetTimeouts(t)
+}
+
+// Lookup returns the backend associated with a five-tuple, or false if
+// no backend is available.  It is LookupPacket for a packet with no TCP
+// flags set.
+func (p *Pool) Lookup(t common.FiveTuple) (*common.Backend, bool) {
+	return p.LookupPacket(t, 0)
+}
+
+// LookupPacket returns the backend for a packet with the given
+// five-tuple and, for TCP, flags, or false if no backend is available.
+// The flags determine how long the connection stays tracked.
+func (p *Pool) LookupPacket(t common.FiveTuple, flags tracking.TCPFlags) (*common.Backend, bool) {
+	return p.tracker.LookupFlow(t.HashWithKey(*p.lookupKey.Load()), t.Protocol, flags)
+}
+
+// backendByIP returns the healthy backend with the given IP address, or
+// false if there is none.
+func (p *Pool) backendByIP(ip []byte) (*common.Backend, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, info := range p.backends {
+		if info.current != nil && bytes.Equal(info.current.IP, ip) {
+			return info.current, true
+		}
+	}
+	return nil, false
+}
+
+// Backend returns the backend with the given address, or false if
+// there is no such backend or it is not healthy.
+func (p *Pool) Backend(address string) (*common.Backend, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	info, ok := p.backends[address]
+	if !ok || info.current == nil {
+		return nil, false
+	}
+	return info.current, true
+}
+
+// AddBackend adds a backend to the pool and starts health checking it.
+// If a backend with the same address exists, it is reconfigured.
+func (p *Pool) AddBackend(b config.Backend) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.setBackend(b)
+}
+
+// RemoveBackend stops health checking a backend and removes it from
+// the pool.
+func (p *Pool) RemoveBackend(address string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.removeBackend(address)
+}
+
+// Reconfigure changes the set of backends to the given one.  Backends
+// which are new are added, backends which are no longer present are
+// removed, and backends whose IP address has changed are replaced.
+// Other backends keep their health state, so connections tracked to
+// them are not dropped.
+func (p *Pool) Reconfigure(backends []config.Backend) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.batch = make(balancer.Config)
+	defer func() {
+		batch := p.batch
+		p.batch = nil
+		if err := p.Balancer().Update(batch); err != nil {
+			// make the changes which can be made
+			for backend, weight := range batch {
+				p.setWeight(backend, weight)
+			}
+		}
+	}()
+
+	want := make(map[string]bool)
+	for _, b := range backends {
+		want[b.Address] = true
+	}
+	for address := range p.backends {
+		if !want[address] {
+			p.removeBackend(address)
+		}
+	}
+	for _, b := range backends {
+		p.setBackend(b)
+	}
+}
+
+// Close stops health checking all backends and removes them, and stops
+// sweeping the connection-tracking table.
+func (p *Pool) Close() {
+	p.Reconfigure(nil)
+	p.closeOnce.Do(func() {
+		close(p.quit)
+	})
+}
+
+// TrackingStats returns the size of the pool's connection-tracking
+// table and its eviction counters.
+func (p *Pool) TrackingStats() tracking.Stats {
+	return p.tracker.Stats()
+}
+
+// SetWeight changes the weight of the backend with the given address,
+// which must be at most common.MaxWeight.  Connections already tracked
+// to it are not affected.
+func (p *Pool) SetWeight(address string, weight uint) error {
+	if weight > common.MaxWeight {
+		return fmt.Errorf("weight %d is more than %d", weight,
+			common.MaxWeight)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	info, ok := p.backends[address]
+	if !ok {
+		return fmt.Errorf("no backend %q", address)
+	}
+	info.cfg.Weight = weight
+	if info.current != nil && info.drain == nil {
+		p.setWeight(info.current, weight)
+	}
+	return nil
+}
+
+// Drain stops sending new connections to the backend with the given
+// address, but keeps sending it the connections already tracked to it
+// while it stays healthy.  The backend is removed once timeout has
+// passed.  Draining a draining backend restarts the timeout, and
+// reconfiguring or adding the backend again stops the drain.
+func (p *Pool) Drain(address string, timeout time.Duration) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	info, ok := p.backends[address]
+	if !ok {
+		return fmt.Errorf("no backend %q", address)
+	}
+	p.drain(address, info, timeout)
+	return nil
+}
+
+// drain drains a backend, as Drain.  p.mutex must be held.
+func (p *Pool) drain(address string, info *backendInfo, timeout time.Duration) {
+	if info.drain != nil {
+		info.drain.Stop()
+	} else if info.current != nil {
+		p.Balancer().Remove(info.current)
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		// the drain may have been stopped or restarted meanwhile
+		if p.backends[address] == info && info.drain == timer {
+			p.removeBackend(address)
+		}
+	})
+	info.drain = timer
+	info.drainEnd = time.Now().Add(timeout)
+}
+
+// Draining returns whether the backend with the given address is
+// draining.
+func (p *Pool) Draining(address string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	info, ok := p.backends[address]
+	return ok && info.drain != nil
+}
+
+// Flows returns the number of connections tracked to the backend with
+// the given address, or false if there is no such backend.
+func (p *Pool) Flows(address string) (int, bool) {
+	p.mutex.Lock()
+	info, ok := p.backends[address]
+	var backend *common.Backend
+	if ok {
+		backend = info.current
+	}
+	p.mutex.Unlock()
+	if !ok {
+		return 0, false
+	}
+	if backend == nil {
+		return 0, true
+	}
+	return p.tracker.Flows(backend), true
+}
+
+// setBackend adds or reconfigures a backend.  p.mutex must be held.
+func (p *Pool) setBackend(b config.Backend) {
+	if info, ok := p.backends[b.Address]; ok {
+		if bytes.Equal(info.cfg.IP, b.IP) {
+			if info.current != nil &&
+				(info.drain != nil || info.cfg.Weight != b.Weight) {
+				p.setWeight(info.current, b.Weight)
+			}
+			if info.drain != nil {
+				info.drain.Stop()
+				info.drain = nil
+			}
+			info.cfg = b
+			info.checker.Set(healthCheck(b), healthOptions(b.Health))
+			return
+		}
+		p.removeBackend(b.Address)
+	}
+
+	quit := make(chan struct{})
+	info := &backendInfo{cfg: b, quit: quit}
+	p.backends[b.Address] = info
+
+	// A backend in the snapshot keeps the weight it had, which may
+	// have been set at runtime, until it is next reconfigured.  If it
+	// was healthy when the snapshot was taken, it is assumed to still
+	// be, so that the balancer is the same as before and its
+	// connections can be restored.  A draining backend keeps draining
+	// for the rest of its timeout.
+	r, restored := p.restored[b.Address]
+	restored = restored && bytes.Equal(r.ip, b.IP)
+	delete(p.restored, b.Address)
+	if restored && r.weight <= common.MaxWeight {
+		info.cfg.Weight = r.weight
+	}
+	healthy := restored && r.healthy
+	if healthy {
+		info.current = &common.Backend{
+			IP:        b.IP,
+			ID:        b.Address,
+			Unhealthy: make(chan struct{}),
+		}
+		if r.drain > 0 {
+			p.drain(b.Address, info, r.drain)
+		} else {
+			p.setWeight(info.current, info.cfg.Weight)
+		}
+		for _, e := range r.entries {
+			e.Backend = info.current
+			p.tracker.Insert(e)
+		}
+	}
+
+	info.checker = health.Start(healthy, healthCheck(b), healthOptions(b.Health),
+		func() {
+			backend := &common.Backend{
+				IP:        b.IP,
+				ID:        b.Address,
+				Unhealthy: make(chan struct{}),
+			}
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			info.current = backend
+			if info.drain == nil {
+				p.setWeight(backend, info.cfg.Weight)
+			}
+			p.healthChanged(b.Address, true)
+		},
+		func() {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			backend := info.current
+			info.current = nil
+			close(backend.Unhealthy)
+			p.Balancer().Remove(backend)
+			p.healthChanged(b.Address, false)
+		},
+		quit)
+}
+
+// setWeight sets a backend's weight in the balancer, or in the
+// batch if one is being collected.  p.mutex must be held.
+func (p *Pool) setWeight(backend *common.Backend, weight uint) {
+	if p.batch != nil {
+		p.batch[backend] = weight
+		return
+	}
+	if err := p.Balancer().SetWeight(backend, weight); err != nil {
+		log.Printf("Cannot add backend %v: %v", backend.ID, err)
+	}
+}
+
+// removeBackend removes a backend.  p.mutex must be held.
+func (p *Pool) removeBackend(address string) {
+	info, ok := p.backends[address]
+	if !ok {
+		return
+	}
+	if info.drain != nil {
+		info.drain.Stop()
+	}
+	close(info.quit)
+	delete(p.backends, address)
+}
+
+func healthCheck(b config.Backend) func(timeout time.Duration) bool {
+	switch b.HealthCheck {
+	case config.HealthCheckHTTP:
+		c, err := httpCheck(b.Address, b.Health.HTTP)
+		if err != nil {
+			return unhealthy(b, err)
+		}
+		return c.Check
+	case config.HealthCheckTCP:
+		return func(timeout time.Duration) bool {
+			return health.TCP(b.Address, timeout)
+		}
+	case config.HealthCheckGRPC:
+		tls, err := b.Health.GRPC.TLSConfig()
+		if err != nil {
+			return unhealthy(b, err)
+		}
+		c := &health.GRPCCheck{
+			Address: b.Address,
+			Service: b.Health.GRPC.Service,
+			TLS:     tls,
+		}
+		return c.Check
+	case config.HealthCheckUDP:
+		c := &health.UDPCheck{
+			Address: b.Address,
+			Request: []byte(b.Health.UDP.Request),
+		}
+		if b.Health.UDP.Response != "" {
+			re, err := regexp.Compile(b.Health.UDP.Response)
+			if err != nil {
+				return unhealthy(b, err)
+			}
+			c.Response = re
+		}
+		return c.Check
+	case config.HealthCheckDNS:
+		c := &health.DNSCheck{
+			Address: b.Address,
+			Name:    b.Health.DNS.Name,
+			Type:    health.DNSTypes[b.Health.DNS.Type],
+		}
+		for _, rcode := range b.Health.DNS.RCodes {
+			c.RCodes = append(c.RCodes, health.DNSRCodes[rcode])
+		}
+		return c.Check
+	default:
+		return func(time.Duration) bool {
+			return true
+		}
+	}
+}
+
+// unhealthy logs why a backend cannot be health checked, and returns a
+// health check which always fails.
+func unhealthy(b config.Backend, err error) func(time.Duration) bool {
+	log.Printf("Cannot health check %v: %v", b.Address, err)
+	return func(time.Duration) bool {
+		return false
+	}
+}
+
+// httpCheck returns the http health check of address configured by cfg.
+func httpCheck(address string, cfg config.HTTPHealth) (*health.HTTPCheck,
+	error) {
+	c := &health.HTTPCheck{
+		URL:     address,
+		Method:  cfg.Method,
+		Host:    cfg.Host,
+		Status:  cfg.Status,
+		MaxBody: cfg.MaxBody,
+	}
+	if len(cfg.Headers) > 0 {
+		c.Header = make(http.Header, len(cfg.Headers))
+		for name, value := range cfg.Headers {
+			c.Header.Set(name, value)
+		}
+	}
+	if cfg.Body != "" {
+		re, err := regexp.Compile(cfg.Body)
+		if err != nil {
+			return nil, err
+		}
+		c.Body = re
+	}
+	tls, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	c.TLS = tls
+	return c, nil
+}
+
+// healthOptions returns the health checking options of a validated
+// configuration, using defaults for those not set.
+func healthOptions(cfg config.Health) health.Options {
+	opts := health.Options{
+		Interval:    cfg.Interval,
+		Timeout:     cfg.Timeout,
+		Rise:        cfg.Rise,
+		Fall:        cfg.Fall,
+		Jitter:      cfg.Jitter,
+		MaxInterval: cfg.MaxInterval,
+	}
+	if opts.Interval == 0 {
+		opts.Interval = pollDelay
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = httpTimeout
+	}
+	if opts.Fall == 0 {
+		opts.Fall = healthFall
+	}
+	if opts.Jitter == 0 {
+		opts.Jitter = healthJitter
+	}
+	return opts
+}
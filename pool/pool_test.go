@@ -0,0 +1,278 @@
+package pool
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/config"
+	"github.com/sipb/spike/maglev"
+)
+
+func newPool() *Pool {
+	return New(common.DefaultLookupKey, maglev.DefaultKey)
+}
+
+func backendCfg(address string, ip ...byte) config.Backend {
+	return config.Backend{
+		Address:     address,
+		IP:          ip,
+		HealthCheck: config.HealthCheckNone,
+		Weight:      1,
+	}
+}
+
+// waitHealthy waits for a backend to become healthy and returns it.
+func waitHealthy(t *testing.T, p *Pool, address string) *common.Backend {
+	var backend *common.Backend
+	require.Eventually(t, func() bool {
+		var ok bool
+		backend, ok = p.Backend(address)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond, "%v never became healthy", address)
+	return backend
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	want := defaultTimeouts
+	want.TCPSyn = 10 * time.Second
+	assert.Equal(t, want, timeouts(config.Timeouts{TCPSyn: 10 * time.Second}))
+}
+
+func TestReconfigure(t *testing.T) {
+	p := newPool()
+	p.Reconfigure([]config.Backend{
+		backendCfg("a", 10, 0, 0, 1),
+		backendCfg("b", 10, 0, 0, 2),
+		backendCfg("c", 10, 0, 0, 3),
+	})
+	a := waitHealthy(t, p, "a")
+	b := waitHealthy(t, p, "b")
+	c := waitHealthy(t, p, "c")
+
+	tuple := common.NewFiveTuple(6,
+		netip.MustParseAddr("1.0.0.0"), 12345,
+		netip.MustParseAddr("18.0.0.0"), 80)
+	tracked, ok := p.Lookup(tuple)
+	require.True(t, ok)
+
+	// remove b, change c's IP, and add d
+	p.Reconfigure([]config.Backend{
+		backendCfg("a", 10, 0, 0, 1),
+		backendCfg("c", 10, 0, 0, 33),
+		backendCfg("d", 10, 0, 0, 4),
+	})
+	waitHealthy(t, p, "d")
+	newC := waitHealthy(t, p, "c")
+
+	cur, ok := p.Backend("a")
+	assert.True(t, ok && cur == a, "unchanged backend was replaced")
+	assert.False(t, isClosed(a.Unhealthy), "unchanged backend went down")
+	require.Eventually(t, func() bool {
+		return isClosed(b.Unhealthy) && isClosed(c.Unhealthy)
+	}, 5*time.Second, 10*time.Millisecond, "old backends still up")
+	_, ok = p.Backend("b")
+	assert.False(t, ok, "removed backend still present")
+	assert.Equal(t, []byte{10, 0, 0, 33}, newC.IP)
+
+	if tracked == a {
+		cur, _ := p.Lookup(tuple)
+		assert.True(t, cur == a, "connection to unchanged backend moved")
+	}
+}
+
+func TestWeight(t *testing.T) {
+	p := newPool()
+	a := backendCfg("a", 10, 0, 0, 1)
+	b := backendCfg("b", 10, 0, 0, 2)
+	b.Weight = 0
+	p.Reconfigure([]config.Backend{a, b})
+	waitHealthy(t, p, "a")
+	waitHealthy(t, p, "b")
+
+	// count how many of a set of five-tuples go to each backend
+	count := func() map[byte]int {
+		counts := make(map[byte]int)
+		for port := uint16(1); port <= 1000; port++ {
+			backend, ok := p.Balancer().Lookup(common.NewFiveTuple(6,
+				netip.MustParseAddr("1.0.0.0"), port,
+				netip.MustParseAddr("18.0.0.0"), 80).Hash())
+			require.True(t, ok)
+			counts[backend.IP[3]]++
+		}
+		return counts
+	}
+	assert.Equal(t, map[byte]int{1: 1000}, count())
+
+	require.NoError(t, p.SetWeight("b", 3))
+	counts := count()
+	assert.InDelta(t, 750, counts[2], 100)
+
+	// reconfiguring with a new weight keeps the backend
+	oldA, _ := p.Backend("a")
+	a.Weight = 3
+	b.Weight = 1
+	p.Reconfigure([]config.Backend{a, b})
+	newA, _ := p.Backend("a")
+	assert.True(t, oldA == newA, "backend replaced on weight change")
+	counts = count()
+	assert.InDelta(t, 750, counts[1], 100)
+
+	assert.Error(t, p.SetWeight("c", 1))
+}
+
+func TestDrain(t *testing.T) {
+	p := newPool()
+	p.Reconfigure([]config.Backend{
+		backendCfg("a", 10, 0, 0, 1),
+		backendCfg("b", 10, 0, 0, 2),
+	})
+	waitHealthy(t, p, "a")
+	b := waitHealthy(t, p, "b")
+
+	tuple := func(port uint16) common.FiveTuple {
+		return common.NewFiveTuple(6,
+			netip.MustParseAddr("1.0.0.0"), port,
+			netip.MustParseAddr("18.0.0.0"), 80)
+	}
+	var tracked []common.FiveTuple
+	for port := uint16(1); port <= 100; port++ {
+		backend, ok := p.Lookup(tuple(port))
+		require.True(t, ok)
+		if backend == b {
+			tracked = append(tracked, tuple(port))
+		}
+	}
+	require.NotEmpty(t, tracked)
+	n, ok := p.Flows("b")
+	require.True(t, ok)
+	assert.Equal(t, len(tracked), n)
+
+	require.NoError(t, p.Drain("b", 200*time.Millisecond))
+	assert.True(t, p.Draining("b"))
+	for _, tu := range tracked {
+		backend, _ := p.Lookup(tu)
+		assert.True(t, backend == b, "tracked connection moved")
+	}
+	for port := uint16(101); port <= 200; port++ {
+		backend, _ := p.Lookup(tuple(port))
+		assert.False(t, backend == b, "new connection to draining backend")
+	}
+	assert.False(t, isClosed(b.Unhealthy), "draining backend went down")
+
+	require.Eventually(t, func() bool {
+		_, ok := p.Flows("b")
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond, "drained backend not removed")
+	require.Eventually(t, func() bool {
+		return isClosed(b.Unhealthy)
+	}, 5*time.Second, 10*time.Millisecond, "drained backend still up")
+	for _, tu := range tracked {
+		backend, _ := p.Lookup(tu)
+		assert.False(t, backend == b, "connection to removed backend")
+	}
+	assert.Error(t, p.Drain("b", time.Second))
+}
+
+func TestUndrain(t *testing.T) {
+	p := newPool()
+	p.Reconfigure([]config.Backend{backendCfg("a", 10, 0, 0, 1)})
+	a := waitHealthy(t, p, "a")
+
+	require.NoError(t, p.Drain("a", 50*time.Millisecond))
+	_, ok := p.Lookup(common.NewFiveTuple(6,
+		netip.MustParseAddr("1.0.0.0"), 1,
+		netip.MustParseAddr("18.0.0.0"), 80))
+	assert.False(t, ok, "new connection to draining backend")
+
+	p.Reconfigure([]config.Backend{backendCfg("a", 10, 0, 0, 1)})
+	assert.False(t, p.Draining("a"))
+	time.Sleep(100 * time.Millisecond)
+	cur, ok := p.Backend("a")
+	assert.True(t, ok && cur == a, "undrained backend was removed")
+	_, ok = p.Lookup(common.NewFiveTuple(6,
+		netip.MustParseAddr("1.0.0.0"), 1,
+		netip.MustParseAddr("18.0.0.0"), 80))
+	assert.True(t, ok, "undrained backend gets no connections")
+}
+
+func TestBalancer(t *testing.T) {
+	p := newPool()
+	p.Reconfigure([]config.Backend{
+		backendCfg("a", 10, 0, 0, 1),
+		backendCfg("b", 10, 0, 0, 2),
+	})
+	waitHealthy(t, p, "a")
+	waitHealthy(t, p, "b")
+	tuple := func(port uint16) common.FiveTuple {
+		return common.NewFiveTuple(17,
+			netip.MustParseAddr("1.0.0.0"), port,
+			netip.MustParseAddr("18.0.0.0"), 53)
+	}
+	tracked, ok := p.Lookup(tuple(1))
+	require.True(t, ok)
+
+	// new connections take turns, and tracked ones stay put
+	p.SetBalancer(config.BalancerRoundRobin)
+	assert.Equal(t, config.BalancerRoundRobin, p.algorithm)
+	first, ok := p.Lookup(tuple(2))
+	require.True(t, ok)
+	second, _ := p.Lookup(tuple(3))
+	assert.NotEqual(t, first.IP, second.IP, "backends did not take turns")
+	cur, _ := p.Lookup(tuple(1))
+	assert.True(t, cur == tracked, "tracked connection moved")
+
+	// the new balancer follows health and weight changes
+	require.NoError(t, p.SetWeight("a", 0))
+	for port := uint16(10); port < 20; port++ {
+		cur, ok := p.Lookup(tuple(port))
+		require.True(t, ok)
+		assert.Equal(t, []byte{10, 0, 0, 2}, cur.IP)
+	}
+
+	p.SetBalancer("")
+	assert.Equal(t, config.BalancerMaglev, p.algorithm)
+	assert.Len(t, p.Balancer().Backends(), 1)
+}
+
+func TestTCPHealthCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	p := newPool()
+	defer p.Close()
+	changes := make(chan bool, 10)
+	p.OnHealthChange(func(address string, healthy bool) {
+		assert.Equal(t, l.Addr().String(), address)
+		changes <- healthy
+	})
+	b := backendCfg(l.Addr().String(), 10, 0, 0, 1)
+	b.HealthCheck = config.HealthCheckTCP
+	b.Health.Interval = 10 * time.Millisecond
+	p.Reconfigure([]config.Backend{b})
+	waitHealthy(t, p, b.Address)
+	assert.True(t, <-changes, "coming up not reported")
+
+	l.Close()
+	select {
+	case healthy := <-changes:
+		assert.False(t, healthy, "going down not reported")
+	case <-time.After(5 * time.Second):
+		t.Error("going down not reported")
+	}
+}
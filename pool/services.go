@@ -0,0 +1,387 @@
+package pool
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/config"
+	"github.com/sipb/spike/maglev"
+	"github.com/sipb/spike/tracking"
+	"github.com/sipb/spike/tracksync"
+)
+
+// defaultSyncInterval is how often every tracked connection is sent to
+// peers, if the configuration does not say.
+const defaultSyncInterval = 30 * time.Second
+
+// defaultTable is the name under which the default pool's connections
+// are synced.  Services are synced under their VIP, as "18.0.0.1:80/tcp".
+const defaultTable = "default"
+
+// Services is a set of virtual services, each with its own pool of
+// backends.  Traffic to a destination which does not match any VIP is
+// sent to the default pool, which holds the backends configured
+// outside of any service.  Services is thread-safe.
+type Services struct {
+	lookupKey common.Key
+	maglevKey common.Key
+	timeouts  tracking.Timeouts
+	def       *Pool
+
+	mutex  sync.RWMutex
+	pools  map[common.VIP]*Pool
+	addrs  map[common.VIP]bool // the VIPs of pools, without their ports
+	syncer *tracksync.Syncer   // nil if not syncing
+
+	snapshotFile     string                   // empty if not saving snapshots
+	snapshotInterval time.Duration            // of the saving goroutine
+	snapshotStop     chan struct{}            // closed to stop saving
+	snapshotStarted  bool                     // whether restored yet
+	restored         map[string]tableSnapshot // by name, until the pool is added
+}
+
+// NewServices constructs a set of services, initially with no services
+// and an empty default pool, using the given hash keys.
+func NewServices(lookupKey, maglevKey common.Key) *Services {
+	return &Services{
+		lookupKey: lookupKey,
+		maglevKey: maglevKey,
+		timeouts:  defaultTimeouts,
+		def:       New(lookupKey, maglevKey),
+		pools:     make(map[common.VIP]*Pool),
+		addrs:     make(map[common.VIP]bool),
+	}
+}
+
+// NewServicesFromConfig constructs a set of services with the hash keys,
+// services and default backends of a validated configuration.
+func NewServicesFromConfig(cfg config.T) *Services {
+	s := NewServices(common.DefaultLookupKey, maglev.DefaultKey)
+	s.SetKeys(cfg)
+	s.SetSnapshot(cfg)
+	s.Reconfigure(cfg)
+	return s
+}
+
+// SetKeys installs the hash keys from a validated configuration, or
+// the default keys if it does not set them.  Changing a key sends most
+// connections which are not tracked to a different backend.
+func (s *Services) SetKeys(cfg config.T) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lookupKey = common.DefaultLookupKey
+	if key, err := common.ParseKey(cfg.LookupKey); err == nil {
+		s.lookupKey = key
+	}
+	s.maglevKey = maglev.DefaultKey
+	if key, err := common.ParseKey(cfg.MaglevKey); err == nil {
+		s.maglevKey = key
+	}
+	s.def.setKeys(s.lookupKey, s.maglevKey)
+	for _, p := range s.pools {
+		p.setKeys(s.lookupKey, s.maglevKey)
+	}
+}
+
+// SetTimeouts installs the connection-tracking timeouts from a
+// validated configuration, using defaults for those not set.
+func (s *Services) SetTimeouts(cfg config.T) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timeouts = timeouts(cfg.Timeouts)
+	s.def.SetTimeouts(s.timeouts)
+	for _, p := range s.pools {
+		p.SetTimeouts(s.timeouts)
+	}
+}
+
+// Default returns the default pool.
+func (s *Services) Default() *Pool {
+	return s.def
+}
+
+// Pool returns the pool of the service with the given VIP, or false if
+// there is no such service.
+func (s *Services) Pool(vip common.VIP) (*Pool, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	p, ok := s.pools[vip]
+	return p, ok
+}
+
+// Pools returns the default pool, followed by the pools of all
+// services.
+func (s *Services) Pools() []*Pool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	pools := make([]*Pool, 0, 1+len(s.pools))
+	pools = append(pools, s.def)
+	for _, p := range s.pools {
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+// SetWeight changes the weight of the backends with the given address
+// in every pool, as Pool.SetWeight.  It returns an error if no pool has
+// such a backend.
+func (s *Services) SetWeight(address string, weight uint) error {
+	if weight > common.MaxWeight {
+		return fmt.Errorf("weight %d is more than %d", weight,
+			common.MaxWeight)
+	}
+	found := false
+	for _, p := range s.Pools() {
+		if p.SetWeight(address, weight) == nil {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no backend %q", address)
+	}
+	return nil
+}
+
+// RemoveBackend removes the backends with the given address from every
+// pool.
+func (s *Services) RemoveBackend(address string) {
+	for _, p := range s.Pools() {
+		p.RemoveBackend(address)
+	}
+}
+
+// Drain drains the backends with the given address in every pool, as
+// Pool.Drain.  It returns an error if no pool has such a backend.
+func (s *Services) Drain(address string, timeout time.Duration) error {
+	found := false
+	for _, p := range s.Pools() {
+		if p.Drain(address, timeout) == nil {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no backend %q", address)
+	}
+	return nil
+}
+
+// Flows returns the number of connections tracked to the backends with
+// the given address in all pools, or false if no pool has such a
+// backend.
+func (s *Services) Flows(address string) (int, bool) {
+	total, found := 0, false
+	for _, p := range s.Pools() {
+		if n, ok := p.Flows(address); ok {
+			total += n
+			found = true
+		}
+	}
+	return total, found
+}
+
+// VIPs returns the VIPs of all services.
+func (s *Services) VIPs() []common.VIP {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	vips := make([]common.VIP, 0, len(s.pools))
+	for vip := range s.pools {
+		vips = append(vips, vip)
+	}
+	return vips
+}
+
+// Lookup returns the backend associated with a five-tuple, choosing the
+// pool by the five-tuple's destination, or false if no backend is
+// available.  A service on the destination's exact port takes
+// precedence over one on any port.  Only destinations whose address and
+// protocol have no service at all go to the default pool, so that, for
+// example, fragments, which have no ports, are not sent to an unrelated
+// backend.  It is LookupPacket for a packet with no TCP flags set.
+func (s *Services) Lookup(t common.FiveTuple) (*common.Backend, bool) {
+	return s.LookupPacket(t, 0)
+}
+
+// LookupPacket is like Lookup, for a packet with the given TCP flags,
+// as Pool.LookupPacket.
+func (s *Services) LookupPacket(t common.FiveTuple, flags tracking.TCPFlags) (*common.Backend, bool) {
+	vip := t.VIP()
+	s.mutex.RLock()
+	p, ok := s.pools[vip]
+	if !ok {
+		vip.Port = 0
+		p, ok = s.pools[vip]
+		if !ok && s.addrs[vip] {
+			s.mutex.RUnlock()
+			return nil, false
+		}
+	}
+	s.mutex.RUnlock()
+	if !ok {
+		p = s.def
+	}
+	return p.LookupPacket(t, flags)
+}
+
+// Reconfigure changes the services, default backends and
+// connection-tracking timeouts to those of a validated configuration.
+// New services are added and services which are no longer present are
+// removed.  The backends of other services are reconfigured as by
+// Pool.Reconfigure, so connections to backends which did not change
+// are not dropped.
+func (s *Services) Reconfigure(cfg config.T) {
+	s.SetTimeouts(cfg)
+	s.ReconfigureServices(cfg.Services)
+	s.def.Reconfigure(cfg.Backends)
+}
+
+// ReconfigureServices is like Reconfigure, but leaves the default pool
+// unchanged.
+func (s *Services) ReconfigureServices(services []config.Service) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	want := make(map[common.VIP]bool)
+	for _, svc := range services {
+		vip := serviceVIP(svc)
+		want[vip] = true
+		p, ok := s.pools[vip]
+		if !ok {
+			p = New(s.lookupKey, s.maglevKey)
+			p.SetTimeouts(s.timeouts)
+			if r, ok := s.restored[vip.String()]; ok {
+				p.restore(r)
+				delete(s.restored, vip.String())
+			}
+			s.pools[vip] = p
+			if s.syncer != nil {
+				s.syncer.AddTable(vip.String(), p.tracker, p.backendByIP)
+			}
+		}
+		p.SetBalancer(svc.Balancer)
+		p.Reconfigure(svc.Backends)
+	}
+	for vip, p := range s.pools {
+		if !want[vip] {
+			if s.syncer != nil {
+				s.syncer.RemoveTable(vip.String())
+			}
+			p.Close()
+			delete(s.pools, vip)
+		}
+	}
+	s.addrs = make(map[common.VIP]bool, len(s.pools))
+	for vip := range s.pools {
+		vip.Port = 0
+		s.addrs[vip] = true
+	}
+}
+
+// SetSync starts sharing tracked connections with the peers in a
+// validated configuration, if it enables syncing.  If syncing has
+// already started, only the set of peers is changed.
+func (s *Services) SetSync(cfg config.T) error {
+	if cfg.Sync.Listen == "" {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.syncer == nil {
+		interval := cfg.Sync.Interval
+		if interval == 0 {
+			interval = defaultSyncInterval
+		}
+		key, err := common.ParseKey(cfg.Sync.Key)
+		if err != nil {
+			return err
+		}
+		syncer, err := tracksync.Listen(cfg.Sync.Listen, interval, key)
+		if err != nil {
+			return err
+		}
+		s.syncer = syncer
+		syncer.AddTable(defaultTable, s.def.tracker, s.def.backendByIP)
+		for vip, p := range s.pools {
+			syncer.AddTable(vip.String(), p.tracker, p.backendByIP)
+		}
+	}
+	return s.syncer.SetPeers(cfg.Sync.Peers)
+}
+
+// Reload reads a configuration file and reconfigures the services with
+// it, their hash keys, the peers they sync with, and how they are
+// snapshotted.  Nothing is changed if the file is invalid.  Other sync
+// settings only take effect on restart.
+func (s *Services) Reload(file string) error {
+	cfg, err := config.Load(file)
+	if err != nil {
+		return err
+	}
+	s.SetKeys(cfg)
+	s.SetSnapshot(cfg)
+	s.Reconfigure(cfg)
+	return s.SetSync(cfg)
+}
+
+// Watch reloads the configuration file whenever its modification time
+// changes, checking every interval, and, if onHUP is set, whenever the
+// process receives SIGHUP.  Only a program which owns the process's
+// signals, unlike a library loaded into another, should set onHUP.
+// Errors are logged.  Close quit to stop watching.
+func (s *Services) Watch(file string, interval time.Duration, onHUP bool,
+	quit <-chan struct{}) {
+	var hup chan os.Signal // nil, so never ready, unless onHUP is set
+	if onHUP {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+
+	modTime := func() time.Time {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+	reload := func() {
+		if err := s.Reload(file); err != nil {
+			log.Printf("Cannot reload config: %v", err)
+		}
+	}
+
+	// read the baseline now, so that a change made before the goroutine
+	// runs is not missed
+	last := modTime()
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-hup:
+				last = modTime()
+				reload()
+			case <-ticker.C:
+				if t := modTime(); !t.Equal(last) {
+					last = t
+					reload()
+				}
+			}
+		}
+	}()
+}
+
+// serviceVIP returns the VIP of a validated service.
+func serviceVIP(svc config.Service) common.VIP {
+	addr, _ := netip.AddrFromSlice(svc.VIP)
+	protocol, _ := common.ParseProtocol(svc.Protocol)
+	return common.VIP{Addr: addr, Protocol: protocol, Port: svc.Port}
+}
@@ -0,0 +1,239 @@
+package pool
+
+import (
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/config"
+	"github.com/sipb/spike/maglev"
+)
+
+func TestServicesLookup(t *testing.T) {
+	s := NewServices(common.DefaultLookupKey, maglev.DefaultKey)
+	s.Reconfigure(config.T{
+		Services: []config.Service{{
+			VIP:      config.IP{18, 0, 0, 1},
+			Protocol: "tcp",
+			Port:     80,
+			Backends: []config.Backend{backendCfg("web", 10, 0, 0, 1)},
+		}, {
+			VIP:      config.IP{18, 0, 0, 1},
+			Protocol: "udp",
+			Backends: []config.Backend{backendCfg("dns", 10, 0, 0, 2)},
+		}},
+		Backends: []config.Backend{backendCfg("other", 10, 0, 0, 3)},
+	})
+	web, ok := s.Pool(common.VIP{
+		Addr:     netip.MustParseAddr("18.0.0.1"),
+		Protocol: common.ProtocolTCP,
+		Port:     80,
+	})
+	require.True(t, ok, "service not found")
+	waitHealthy(t, web, "web")
+	dns, ok := s.Pool(common.VIP{
+		Addr:     netip.MustParseAddr("18.0.0.1"),
+		Protocol: common.ProtocolUDP,
+	})
+	require.True(t, ok, "service not found")
+	waitHealthy(t, dns, "dns")
+	waitHealthy(t, s.Default(), "other")
+	assert.Len(t, s.VIPs(), 2)
+
+	lookup := func(s *Services, tuple string) []byte {
+		tu, err := common.ParseFiveTuple(tuple)
+		require.NoError(t, err)
+		b, ok := s.Lookup(tu)
+		require.True(t, ok, "%v: lookup failed", tuple)
+		return b.IP
+	}
+	assert.Equal(t, []byte{10, 0, 0, 1}, lookup(s, "1.0.0.0/1234/18.0.0.1/80/6"))
+	assert.Equal(t, []byte{10, 0, 0, 2}, lookup(s, "1.0.0.0/1234/18.0.0.1/53/17"))
+	assert.Equal(t, []byte{10, 0, 0, 2}, lookup(s, "1.0.0.0/1234/18.0.0.1/5353/17"))
+	assert.Equal(t, []byte{10, 0, 0, 3}, lookup(s, "1.0.0.0/1234/18.0.0.2/80/6"))
+	assert.Equal(t, []byte{10, 0, 0, 3}, lookup(s, "1.0.0.0/1234/18.0.0.1/0/1"))
+	// other ports of an address and protocol with a service, and their
+	// fragments, do not go to the default service
+	for _, tuple := range []string{
+		"1.0.0.0/1234/18.0.0.1/443/6",
+		"1.0.0.0/0/18.0.0.1/0/6",
+	} {
+		tu, err := common.ParseFiveTuple(tuple)
+		require.NoError(t, err)
+		_, ok := s.Lookup(tu)
+		assert.False(t, ok, "%v: sent to the default service", tuple)
+	}
+
+	// removing a service stops its health checks
+	s.Reconfigure(config.T{})
+	assert.Empty(t, s.VIPs())
+	_, ok = web.Backend("web")
+	assert.False(t, ok, "removed service still has backends")
+}
+
+// servicesWithWeb returns services with a web backend in both the
+// default pool and a service's pool, and the service's pool.
+func servicesWithWeb(t *testing.T) (*Services, *Pool) {
+	s := NewServices(common.DefaultLookupKey, maglev.DefaultKey)
+	s.Reconfigure(config.T{
+		Services: []config.Service{{
+			VIP:      config.IP{18, 0, 0, 1},
+			Protocol: "tcp",
+			Port:     80,
+			Backends: []config.Backend{
+				backendCfg("web", 10, 0, 0, 1),
+				backendCfg("other", 10, 0, 0, 2),
+			},
+		}},
+		Backends: []config.Backend{backendCfg("web", 10, 0, 0, 1)},
+	})
+	p, ok := s.Pool(common.VIP{
+		Addr:     netip.MustParseAddr("18.0.0.1"),
+		Protocol: common.ProtocolTCP,
+		Port:     80,
+	})
+	require.True(t, ok, "service not found")
+	waitHealthy(t, p, "web")
+	waitHealthy(t, s.Default(), "web")
+	assert.Len(t, s.Pools(), 2)
+	return s, p
+}
+
+func TestServicesBackends(t *testing.T) {
+	s, p := servicesWithWeb(t)
+	defer s.Reconfigure(config.T{})
+
+	require.NoError(t, s.SetWeight("web", 0))
+	for _, pool := range s.Pools() {
+		assert.NotContains(t, pool.Balancer().Backends(),
+			waitHealthy(t, pool, "web"), "weight 0 backend still balanced")
+	}
+	assert.Error(t, s.SetWeight("nonexistent", 1))
+
+	s.RemoveBackend("web")
+	_, ok := p.Backend("web")
+	assert.False(t, ok, "service backend not removed")
+	_, ok = s.Default().Backend("web")
+	assert.False(t, ok, "default backend not removed")
+	waitHealthy(t, p, "other")
+}
+
+func TestServicesDrain(t *testing.T) {
+	s, p := servicesWithWeb(t)
+	defer s.Reconfigure(config.T{})
+
+	tuple, err := common.ParseFiveTuple("1.0.0.0/1234/18.0.0.2/80/6")
+	require.NoError(t, err)
+	s.Lookup(tuple) // tracked to web in the default pool
+	n, ok := s.Flows("web")
+	require.True(t, ok)
+	assert.Equal(t, 1, n)
+	_, ok = s.Flows("nonexistent")
+	assert.False(t, ok)
+
+	require.NoError(t, s.Drain("web", 50*time.Millisecond))
+	assert.True(t, p.Draining("web"), "service backend not draining")
+	assert.True(t, s.Default().Draining("web"), "default backend not draining")
+	assert.Error(t, s.Drain("nonexistent", time.Second))
+	require.Eventually(t, func() bool {
+		_, ok := s.Flows("web")
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond, "drained backend not removed")
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spike")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "spike.yaml")
+
+	write := func(s string) {
+		require.NoError(t, ioutil.WriteFile(file, []byte(s), 0644))
+	}
+	write(`backends:
+    - address: a
+      ip: 10.0.0.1
+      healthcheck: none
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`)
+	s := NewServices(common.DefaultLookupKey, maglev.DefaultKey)
+	require.NoError(t, s.Reload(file))
+	waitHealthy(t, s.Default(), "a")
+
+	write("backends: [\n")
+	assert.Error(t, s.Reload(file))
+	_, ok := s.Default().Backend("a")
+	assert.True(t, ok, "invalid config changed the pool")
+
+	quit := make(chan struct{})
+	defer close(quit)
+	s.Watch(file, 10*time.Millisecond, false, quit)
+	write(`services:
+    - vip: 18.0.0.1
+      protocol: tcp
+      port: 80
+      backends:
+          - address: b
+            ip: 10.0.0.2
+            healthcheck: none
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+`)
+	// make sure the modification time changes
+	require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(time.Second)))
+	require.Eventually(t, func() bool {
+		return len(s.VIPs()) == 1
+	}, 5*time.Second, 10*time.Millisecond, "watched reload did not happen")
+	p, _ := s.Pool(s.VIPs()[0])
+	waitHealthy(t, p, "b")
+	_, ok = s.Default().Backend("a")
+	assert.False(t, ok, "watched reload did not remove backend")
+}
+
+func TestReloadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spike")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "spike.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`backends:
+    - address: a
+      ip: 10.0.0.1
+      healthcheck: none
+dstmac: 22:22:22:22:22:22
+ipv4address: 1.3.5.7
+lookupkey: 000102030405060708090a0b0c0d0e0f
+maglevkey: 0f0e0d0c0b0a09080706050403020100
+`), 0644))
+
+	s := NewServices(common.DefaultLookupKey, maglev.DefaultKey)
+	s.Reconfigure(config.T{
+		Backends: []config.Backend{backendCfg("a", 10, 0, 0, 1)},
+	})
+	waitHealthy(t, s.Default(), "a")
+	tuple, err := common.ParseFiveTuple("1.0.0.0/1234/18.0.0.1/80/6")
+	require.NoError(t, err)
+
+	// keys can change while connections are looked up
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			s.Lookup(tuple)
+		}
+	}()
+	require.NoError(t, s.Reload(file))
+	<-done
+
+	assert.Equal(t, common.Key{K0: 0x0f0e0d0c0b0a0908, K1: 0x0706050403020100},
+		s.Default().Balancer().(*maglev.Table).Key())
+	assert.Equal(t, common.Key{K0: 0x0001020304050607, K1: 0x08090a0b0c0d0e0f},
+		*s.Default().lookupKey.Load())
+}
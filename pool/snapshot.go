@@ -0,0 +1,410 @@
+package pool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/config"
+	"github.com/sipb/spike/tracking"
+)
+
+// A snapshot file holds the backends and tracked connections of every
+// pool, so that they survive a restart.  It is, in network byte order:
+//
+//	magic    [8]byte "SPIKESNP"
+//	version  uint16  2
+//	time     int64, Unix nanoseconds when it was written
+//	keycheck uint64, a hash identifying the lookup key
+//	ntables  uint32
+//	tables   [ntables]table
+//	crc      uint32, CRC-32 (IEEE) of everything before it
+//
+// where a table is a pool, named as for tracksync:
+//
+//	namelen   uint8
+//	name      [namelen]byte
+//	nbackends uint32
+//	backends  [nbackends]backend
+//
+// and a backend is:
+//
+//	addrlen  uint16
+//	address  [addrlen]byte
+//	iplen    uint8
+//	ip       [iplen]byte
+//	weight   uint32
+//	healthy  uint8, 1 if healthy
+//	drain    uint32, milliseconds until a draining backend is removed,
+//	         or 0 if it is not draining
+//	nentries uint32
+//	entries  [nentries]entry, the connections tracked to it
+//
+// and an entry is:
+//
+//	key   uint64
+//	state uint8, a tracking.State
+//	ttl   uint32, milliseconds until it expires
+const (
+	snapshotMagic   = "SPIKESNP"
+	snapshotVersion = 2
+
+	defaultSnapshotInterval = time.Minute
+)
+
+var errBadSnapshot = errors.New("malformed snapshot")
+
+type backendSnapshot struct {
+	address string
+	ip      []byte
+	weight  uint
+	healthy bool
+	drain   time.Duration    // until a draining backend is removed, or 0
+	entries []tracking.Entry // with no Backend
+}
+
+type tableSnapshot struct {
+	name     string
+	backends []backendSnapshot
+}
+
+// keyCheck returns a hash identifying a lookup key, so that a snapshot
+// taken with a different key, whose connections would not be found,
+// is not restored.
+func keyCheck(key common.Key) uint64 {
+	return key.Hash([]byte(snapshotMagic))
+}
+
+// snapshot returns the state of the pool under the given name.
+func (p *Pool) snapshot(name string) tableSnapshot {
+	t := tableSnapshot{name: name}
+	index := make(map[*common.Backend]int)
+	p.mutex.Lock()
+	for address, info := range p.backends {
+		if info.current != nil {
+			index[info.current] = len(t.backends)
+		}
+		bs := backendSnapshot{
+			address: address,
+			ip:      info.cfg.IP,
+			weight:  info.cfg.Weight,
+			healthy: info.current != nil,
+		}
+		if info.drain != nil {
+			// a drain about to end must still be saved as one
+			bs.drain = time.Until(info.drainEnd)
+			if bs.drain < time.Millisecond {
+				bs.drain = time.Millisecond
+			}
+		}
+		t.backends = append(t.backends, bs)
+	}
+	p.mutex.Unlock()
+
+	for _, e := range p.tracker.Entries() {
+		if i, ok := index[e.Backend]; ok {
+			e.Backend = nil
+			t.backends[i].entries = append(t.backends[i].entries, e)
+		}
+	}
+	return t
+}
+
+// restore arranges for backends to start in the state they have in a
+// snapshot when they are added.
+func (p *Pool) restore(t tableSnapshot) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.restored = make(map[string]backendSnapshot)
+	for _, b := range t.backends {
+		p.restored[b.address] = b
+	}
+}
+
+// SetSnapshot starts saving the pools to the snapshot file of a
+// validated configuration every interval, or stops saving them if it
+// has none.  The first time it is given a file, it also restores the
+// snapshot: backends which were healthy start healthy, with the
+// connections tracked to them, when they are added, and those which
+// were draining keep draining.  It should
+// therefore be called before the backends are added.  A missing or
+// invalid snapshot is logged and ignored, so that spike always starts.
+func (s *Services) SetSnapshot(cfg config.T) {
+	file := cfg.Snapshot.File
+	interval := cfg.Snapshot.Interval
+	if interval == 0 {
+		interval = defaultSnapshotInterval
+	}
+
+	s.mutex.Lock()
+	restore := file != "" && !s.snapshotStarted
+	if file != "" {
+		s.snapshotStarted = true
+	}
+	s.snapshotFile = file
+	if s.snapshotStop != nil &&
+		(file == "" || interval != s.snapshotInterval) {
+		close(s.snapshotStop)
+		s.snapshotStop = nil
+	}
+	var stop chan struct{}
+	if file != "" && s.snapshotStop == nil {
+		stop = make(chan struct{})
+		s.snapshotStop, s.snapshotInterval = stop, interval
+	}
+	s.mutex.Unlock()
+
+	if restore {
+		if err := s.Restore(file); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Cannot restore snapshot: %v", err)
+			}
+		}
+	}
+	if stop != nil {
+		go s.saveSnapshots(interval, stop)
+	}
+}
+
+// StopSnapshot stops saving the pools periodically.  On shutdown, call
+// it and then SaveSnapshot.
+func (s *Services) StopSnapshot() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.snapshotStop != nil {
+		close(s.snapshotStop)
+		s.snapshotStop = nil
+	}
+}
+
+// saveSnapshots saves the pools every interval until stop is closed.
+func (s *Services) saveSnapshots(interval time.Duration,
+	stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.SaveSnapshot(); err != nil {
+				log.Printf("Cannot save snapshot: %v", err)
+			}
+		}
+	}
+}
+
+// SaveSnapshot saves the pools to the configured snapshot file, if
+// any.  It should be called on shutdown.
+func (s *Services) SaveSnapshot() error {
+	s.mutex.RLock()
+	file := s.snapshotFile
+	s.mutex.RUnlock()
+	if file == "" {
+		return nil
+	}
+	return s.WriteSnapshot(file)
+}
+
+// WriteSnapshot saves the pools to a file, replacing it atomically.  The
+// file is synced before it replaces the old one, so that a crash leaves
+// one or the other, and its directory after.
+func (s *Services) WriteSnapshot(file string) error {
+	s.mutex.RLock()
+	key := s.lookupKey
+	tables := []tableSnapshot{s.def.snapshot(defaultTable)}
+	for vip, p := range s.pools {
+		tables = append(tables, p.snapshot(vip.String()))
+	}
+	s.mutex.RUnlock()
+
+	dat := encodeSnapshot(tables, keyCheck(key), time.Now())
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Restore reads a snapshot file written by WriteSnapshot.  Backends in
+// it start in their saved state when they are next added, to the
+// default pool or to a service added by a later Reconfigure.
+func (s *Services) Restore(file string) error {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tables, err := decodeSnapshot(dat, keyCheck(s.lookupKey), time.Now())
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	s.restored = make(map[string]tableSnapshot)
+	for _, t := range tables {
+		if t.name == defaultTable {
+			s.def.restore(t)
+		} else {
+			s.restored[t.name] = t
+		}
+	}
+	return nil
+}
+
+func encodeSnapshot(tables []tableSnapshot, keyCheck uint64, now time.Time) []byte {
+	b := []byte(snapshotMagic)
+	b = binary.BigEndian.AppendUint16(b, snapshotVersion)
+	b = binary.BigEndian.AppendUint64(b, uint64(now.UnixNano()))
+	b = binary.BigEndian.AppendUint64(b, keyCheck)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(tables)))
+	for _, t := range tables {
+		b = append(b, byte(len(t.name)))
+		b = append(b, t.name...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(t.backends)))
+		for _, bs := range t.backends {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(bs.address)))
+			b = append(b, bs.address...)
+			b = append(b, byte(len(bs.ip)))
+			b = append(b, bs.ip...)
+			b = binary.BigEndian.AppendUint32(b, uint32(bs.weight))
+			healthy := byte(0)
+			if bs.healthy {
+				healthy = 1
+			}
+			b = append(b, healthy)
+			drain := bs.drain / time.Millisecond
+			if drain > 1<<32-1 {
+				drain = 1<<32 - 1
+			}
+			b = binary.BigEndian.AppendUint32(b, uint32(drain))
+
+			countOff := len(b)
+			b = append(b, 0, 0, 0, 0)
+			count := 0
+			for _, e := range bs.entries {
+				ttl := e.Expire.Sub(now) / time.Millisecond
+				if ttl <= 0 {
+					continue
+				}
+				if ttl > 1<<32-1 {
+					ttl = 1<<32 - 1
+				}
+				b = binary.BigEndian.AppendUint64(b, e.Key)
+				b = append(b, byte(e.State))
+				b = binary.BigEndian.AppendUint32(b, uint32(ttl))
+				count++
+			}
+			binary.BigEndian.PutUint32(b[countOff:], uint32(count))
+		}
+	}
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// A snapshotReader reads fields from a snapshot, remembering whether it
+// ran out of data.
+type snapshotReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *snapshotReader) bytes(n int) []byte {
+	if r.bad || len(r.b) < n {
+		r.bad = true
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *snapshotReader) uint8() uint8   { return r.bytes(1)[0] }
+func (r *snapshotReader) uint16() uint16 { return binary.BigEndian.Uint16(r.bytes(2)) }
+func (r *snapshotReader) uint32() uint32 { return binary.BigEndian.Uint32(r.bytes(4)) }
+func (r *snapshotReader) uint64() uint64 { return binary.BigEndian.Uint64(r.bytes(8)) }
+
+// decodeSnapshot decodes a snapshot, restoring its entries' expiry
+// times relative to now.  If the snapshot was taken with a different
+// lookup key, its connections are dropped but its backends are kept.
+func decodeSnapshot(dat []byte, keyCheck uint64, now time.Time) ([]tableSnapshot, error) {
+	if len(dat) < len(snapshotMagic)+2+4 ||
+		!bytes.Equal(dat[:len(snapshotMagic)], []byte(snapshotMagic)) {
+		return nil, errors.New("not a snapshot")
+	}
+	body := dat[:len(dat)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(dat[len(body):]) {
+		return nil, errors.New("snapshot checksum mismatch")
+	}
+	r := &snapshotReader{b: body[len(snapshotMagic):]}
+	if v := r.uint16(); v != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	written := time.Unix(0, int64(r.uint64()))
+	sameKey := r.uint64() == keyCheck
+
+	var tables []tableSnapshot
+	for n := r.uint32(); n > 0 && !r.bad; n-- {
+		t := tableSnapshot{name: string(r.bytes(int(r.uint8())))}
+		for n := r.uint32(); n > 0 && !r.bad; n-- {
+			bs := backendSnapshot{
+				address: string(r.bytes(int(r.uint16()))),
+				ip:      append([]byte(nil), r.bytes(int(r.uint8()))...),
+				weight:  uint(r.uint32()),
+				healthy: r.uint8() == 1,
+			}
+			if drain := r.uint32(); drain > 0 {
+				bs.drain = time.Duration(drain)*time.Millisecond -
+					now.Sub(written)
+				if bs.drain <= 0 {
+					// the backend would have been removed, and its
+					// connections with it
+					bs.healthy, bs.drain = false, 0
+				}
+			}
+			for n := r.uint32(); n > 0 && !r.bad; n-- {
+				e := tracking.Entry{
+					Key:   r.uint64(),
+					State: tracking.State(r.uint8()),
+				}
+				ttl := time.Duration(r.uint32()) * time.Millisecond
+				e.Expire = now.Add(ttl - now.Sub(written))
+				if sameKey && bs.healthy && e.Expire.After(now) {
+					bs.entries = append(bs.entries, e)
+				}
+			}
+			t.backends = append(t.backends, bs)
+		}
+		tables = append(tables, t)
+	}
+	if r.bad || len(r.b) != 0 {
+		return nil, errBadSnapshot
+	}
+	return tables, nil
+}
@@ -0,0 +1,223 @@
+package pool
+
+import (
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/config"
+	"github.com/sipb/spike/maglev"
+	"github.com/sipb/spike/tracking"
+)
+
+func TestSnapshotEncoding(t *testing.T) {
+	now := time.Now()
+	tables := []tableSnapshot{{
+		name: defaultTable,
+		backends: []backendSnapshot{{
+			address: "a",
+			ip:      []byte{10, 0, 0, 1},
+			weight:  2,
+			healthy: true,
+			entries: []tracking.Entry{{
+				Key:    1,
+				State:  tracking.StateTCPEstablished,
+				Expire: now.Add(time.Minute),
+			}, {
+				Key:    2,
+				Expire: now.Add(-time.Minute),
+			}},
+		}, {
+			address: "b",
+			ip:      []byte{0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2},
+			weight:  1,
+		}, {
+			address: "c",
+			ip:      []byte{10, 0, 0, 3},
+			weight:  1,
+			healthy: true,
+			drain:   time.Minute,
+			entries: []tracking.Entry{{Key: 3, Expire: now.Add(time.Minute)}},
+		}, {
+			address: "d",
+			ip:      []byte{10, 0, 0, 4},
+			weight:  1,
+			healthy: true,
+			drain:   time.Millisecond,
+			entries: []tracking.Entry{{Key: 4, Expire: now.Add(time.Minute)}},
+		}},
+	}, {
+		name: "18.0.0.1:80/tcp",
+	}}
+	dat := encodeSnapshot(tables, 42, now)
+
+	// restored a second later
+	got, err := decodeSnapshot(dat, 42, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, "18.0.0.1:80/tcp", got[1].name)
+	require.Len(t, got[0].backends, 4)
+	a := got[0].backends[0]
+	assert.Equal(t, "a", a.address)
+	assert.Equal(t, []byte{10, 0, 0, 1}, a.ip)
+	assert.Equal(t, uint(2), a.weight)
+	assert.True(t, a.healthy)
+	require.Len(t, a.entries, 1, "expired entry restored")
+	assert.Equal(t, uint64(1), a.entries[0].Key)
+	assert.Equal(t, tracking.StateTCPEstablished, a.entries[0].State)
+	assert.WithinDuration(t, now.Add(time.Minute), a.entries[0].Expire,
+		time.Millisecond)
+	assert.Equal(t, tables[0].backends[1].ip, got[0].backends[1].ip)
+	assert.False(t, got[0].backends[1].healthy)
+	assert.Zero(t, a.drain)
+	// a draining backend keeps draining for the rest of its timeout
+	c := got[0].backends[2]
+	assert.True(t, c.healthy)
+	assert.InDelta(t, float64(59*time.Second), float64(c.drain),
+		float64(time.Millisecond))
+	assert.Len(t, c.entries, 1)
+	// unless it has ended, when the backend would have been removed
+	d := got[0].backends[3]
+	assert.False(t, d.healthy)
+	assert.Zero(t, d.drain)
+	assert.Empty(t, d.entries)
+
+	// with a different lookup key, connections are not restored
+	got, err = decodeSnapshot(dat, 43, now)
+	require.NoError(t, err)
+	assert.Empty(t, got[0].backends[0].entries)
+	assert.True(t, got[0].backends[0].healthy)
+
+	corrupt := append([]byte(nil), dat...)
+	corrupt[20]++
+	_, err = decodeSnapshot(corrupt, 42, now)
+	assert.Error(t, err)
+	_, err = decodeSnapshot(dat[:len(dat)-1], 42, now)
+	assert.Error(t, err)
+	_, err = decodeSnapshot([]byte("not a snapshot"), 42, now)
+	assert.Error(t, err)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spike")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "snapshot")
+
+	cfg := config.T{
+		Services: []config.Service{{
+			VIP:      config.IP{18, 0, 0, 1},
+			Protocol: "tcp",
+			Backends: []config.Backend{backendCfg("c", 10, 0, 0, 3)},
+		}},
+		Backends: []config.Backend{
+			backendCfg("a", 10, 0, 0, 1),
+			backendCfg("b", 10, 0, 0, 2),
+		},
+	}
+	tuple := func(dst string, port uint16) common.FiveTuple {
+		return common.NewFiveTuple(6,
+			netip.MustParseAddr("1.0.0.0"), port,
+			netip.MustParseAddr(dst), 80)
+	}
+
+	s := NewServices(common.DefaultLookupKey, maglev.DefaultKey)
+	s.Reconfigure(cfg)
+	waitHealthy(t, s.Default(), "a")
+	waitHealthy(t, s.Default(), "b")
+	svc, _ := s.Pool(common.VIP{
+		Addr:     netip.MustParseAddr("18.0.0.1"),
+		Protocol: common.ProtocolTCP,
+	})
+	waitHealthy(t, svc, "c")
+	before := make(map[uint16][]byte)
+	for port := uint16(1); port <= 50; port++ {
+		b, ok := s.Lookup(tuple("18.0.0.2", port))
+		require.True(t, ok)
+		before[port] = b.IP
+	}
+	_, ok := s.Lookup(tuple("18.0.0.1", 1))
+	require.True(t, ok)
+	require.NoError(t, svc.SetWeight("c", 3))
+	// draining keeps a's connections but sends it no new ones
+	require.NoError(t, s.Default().Drain("a", time.Minute))
+	require.NoError(t, s.WriteSnapshot(file))
+
+	// after a restart, the backends start healthy without waiting for
+	// a health check, and connections keep their backends
+	s2 := NewServices(common.DefaultLookupKey, maglev.DefaultKey)
+	require.NoError(t, s2.Restore(file))
+	s2.Reconfigure(cfg)
+	_, ok = s2.Default().Backend("b")
+	assert.True(t, ok, "restored backend not healthy")
+	for port, ip := range before {
+		b, ok := s2.Lookup(tuple("18.0.0.2", port))
+		require.True(t, ok)
+		assert.Equal(t, ip, b.IP, "port %d moved", port)
+	}
+	assert.True(t, s2.Default().Draining("a"), "drain not restored")
+	for port := uint16(51); port <= 100; port++ {
+		b, ok := s2.Lookup(tuple("18.0.0.2", port))
+		require.True(t, ok)
+		assert.Equal(t, []byte{10, 0, 0, 2}, b.IP,
+			"new connection sent to draining backend")
+	}
+	svc2, _ := s2.Pool(common.VIP{
+		Addr:     netip.MustParseAddr("18.0.0.1"),
+		Protocol: common.ProtocolTCP,
+	})
+	n, _ := svc2.Flows("c")
+	assert.Equal(t, 1, n, "service connection not restored")
+	_, weight, _ := svc2.Balancer().(*maglev.Table).Backend("c")
+	assert.Equal(t, uint(3), weight, "weight set at runtime not restored")
+}
+
+func TestSnapshotPeriodic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spike")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "snapshot")
+	exists := func() bool {
+		_, err := os.Stat(file)
+		return err == nil
+	}
+
+	s := NewServices(common.DefaultLookupKey, maglev.DefaultKey)
+	cfg := config.T{Snapshot: config.Snapshot{
+		File:     file,
+		Interval: 10 * time.Millisecond,
+	}}
+	s.SetSnapshot(cfg)
+	require.Eventually(t, exists, 5*time.Second, 5*time.Millisecond,
+		"snapshot not saved")
+
+	// changing the interval replaces the saving goroutine
+	cfg.Snapshot.Interval = 20 * time.Millisecond
+	s.SetSnapshot(cfg)
+	require.NoError(t, os.Remove(file))
+	require.Eventually(t, exists, 5*time.Second, 5*time.Millisecond,
+		"snapshot not saved at the new interval")
+
+	// with no file, saving stops
+	s.SetSnapshot(config.T{})
+	time.Sleep(20 * time.Millisecond) // let a save in progress finish
+	os.Remove(file)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, exists(), "snapshot saved after stopping")
+
+	s.SetSnapshot(cfg)
+	require.Eventually(t, exists, 5*time.Second, 5*time.Millisecond,
+		"snapshot not saved after restarting")
+	s.StopSnapshot()
+	time.Sleep(20 * time.Millisecond)
+	os.Remove(file)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, exists(), "snapshot saved after StopSnapshot")
+}
@@ -1,66 +1,441 @@
 package tracking
 
 import (
+	"container/list"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sipb/spike/common"
 )
 
-type entry struct {
-	backend *common.Backend
-	expire  time.Time
+// numShards is the number of independently locked parts of a Cache.
+// It must be a power of two.
+const numShards = 256
+
+// TCPFlags are the flags in a TCP header.
+type TCPFlags uint8
+
+// TCP flags used to track connection state.
+const (
+	TCPFIN TCPFlags = 0x01
+	TCPSYN TCPFlags = 0x02
+	TCPRST TCPFlags = 0x04
+	TCPACK TCPFlags = 0x10
+)
+
+const (
+	protocolTCP = 6
+	protocolUDP = 17
+)
+
+// Timeouts are how long entries are kept without being accessed,
+// depending on the state of the connection.
+type Timeouts struct {
+	TCPSyn         time.Duration // SYN seen, but no further packets
+	TCPEstablished time.Duration
+	TCPClosing     time.Duration // FIN or RST seen
+	UDP            time.Duration
+	Other          time.Duration // other protocols, or unknown
+}
+
+// Uniform returns timeouts which are all d.
+func Uniform(d time.Duration) Timeouts {
+	return Timeouts{d, d, d, d, d}
+}
+
+// A State is the state of a tracked connection.
+type State uint8
+
+// Connection states.
+const (
+	StateOther State = iota // not TCP or UDP, or unknown
+	StateUDP
+	StateTCPSyn // SYN seen, but no further packets
+	StateTCPEstablished
+	StateTCPClosing // FIN or RST seen
+)
+
+// next returns the state of a connection in state s after a packet
+// with the given protocol and TCP flags.  New connections start in
+// StateOther.  Since spike only sees packets from clients, a TCP
+// connection is established once any packet other than the SYN is
+// seen, including the first packet seen of a connection which started
+// elsewhere.
+func (s State) next(protocol uint8, flags TCPFlags) State {
+	switch protocol {
+	case protocolTCP:
+		switch {
+		case flags&(TCPFIN|TCPRST) != 0:
+			return StateTCPClosing
+		case flags&TCPSYN != 0 && flags&TCPACK == 0:
+			return StateTCPSyn
+		case s == StateTCPClosing:
+			return s
+		default:
+			return StateTCPEstablished
+		}
+	case protocolUDP:
+		return StateUDP
+	default:
+		return s
+	}
+}
+
+// Timeout returns the timeout of connections in state s.
+func (t *Timeouts) Timeout(s State) time.Duration {
+	switch s {
+	case StateUDP:
+		return t.UDP
+	case StateTCPSyn:
+		return t.TCPSyn
+	case StateTCPEstablished:
+		return t.TCPEstablished
+	case StateTCPClosing:
+		return t.TCPClosing
+	default:
+		return t.Other
+	}
 }
 
-// Cache is a connection-tracking table.  It lazily evicts entries when
-// the backend becomes unhealthy or when the entry expires by not been
-// accessed.
+// An Entry is a tracked connection.
+type Entry struct {
+	Key     uint64
+	Backend *common.Backend
+	State   State
+	Expire  time.Time
+}
+
+// A shard is part of a Cache.  Its entries are kept in a list from most
+// to least recently used, so the least recently used entry is evicted
+// when the shard is full.
+type shard struct {
+	mutex sync.Mutex
+	table map[uint64]*list.Element // of *Entry
+	lru   list.List
+	max   int // 0 if unbounded
+}
+
+// Cache is a connection-tracking table.  Entries are evicted when the
+// backend becomes unhealthy or when the entry expires by not being
+// accessed within the timeout for the connection's state; this happens
+// lazily when they are looked up, and actively when the cache is
+// swept.  If the cache has a maximum size, it stays within it by
+// evicting the entries that have gone longest without being accessed.
 //
-// Cache is not thread-safe.
+// Cache is thread-safe.  It is split into shards by key, each with its
+// own lock, so lookups of different connections rarely contend.  Each
+// shard holds an equal part of the maximum size and evicts its own
+// least recently used entry, so eviction is approximately LRU.
 type Cache struct {
-	table  map[uint64]entry
-	miss   func(uint64) (*common.Backend, bool)
-	expiry time.Duration
+	shards   []shard
+	mask     uint64
+	miss     func(uint64) (*common.Backend, bool)
+	timeouts atomic.Value // Timeouts
+	onChange atomic.Value // func(Entry)
+
+	expired   uint64 // atomic
+	unhealthy uint64 // atomic
+	capacity  uint64 // atomic
+}
+
+// Stats are the number of entries in a Cache and the number evicted
+// for each reason.
+type Stats struct {
+	Entries int
+
+	Expired   uint64 // not accessed within the expiry time
+	Unhealthy uint64 // backend became unhealthy
+	Capacity  uint64 // least recently used when the cache was full
 }
 
-// New constructs a new connection-tracking table which caches the given
-// function.
+// New constructs a new connection-tracking table of unbounded size
+// which caches the given function, keeping every entry for expiry.  The
+// function must be safe to call concurrently.
 func New(
 	miss func(uint64) (*common.Backend, bool),
 	expiry time.Duration,
 ) *Cache {
-	return &Cache{
-		table:  make(map[uint64]entry),
+	return NewWithLimit(miss, Uniform(expiry), 0)
+}
+
+// NewWithLimit is like New, but with the given timeouts, and the table
+// holds at most about max entries.  A max of zero means no limit.
+func NewWithLimit(
+	miss func(uint64) (*common.Backend, bool),
+	timeouts Timeouts,
+	max int,
+) *Cache {
+	return newSharded(miss, timeouts, max, numShards)
+}
+
+// newSharded is like NewWithLimit, but with the given number of
+// shards, which must be a power of two.
+func newSharded(
+	miss func(uint64) (*common.Backend, bool),
+	timeouts Timeouts,
+	max int,
+	shards int,
+) *Cache {
+	c := &Cache{
+		shards: make([]shard, shards),
+		mask:   uint64(shards - 1),
 		miss:   miss,
-		expiry: expiry,
 	}
+	c.SetTimeouts(timeouts)
+	perShard := 0
+	if max > 0 {
+		perShard = (max + shards - 1) / shards
+	}
+	for i := range c.shards {
+		c.shards[i].table = make(map[uint64]*list.Element)
+		c.shards[i].max = perShard
+	}
+	return c
+}
+
+// shard returns the shard holding the given key.  The key is a hash,
+// but its low bits also choose the Maglev slot, so the shard is chosen
+// by its high bits.
+func (c *Cache) shard(key uint64) *shard {
+	return &c.shards[(key>>32)&c.mask]
+}
+
+// SetTimeouts changes the timeouts.  Entries already in the table keep
+// their current expiry time until they are next accessed.
+func (c *Cache) SetTimeouts(timeouts Timeouts) {
+	c.timeouts.Store(timeouts)
+}
+
+// Timeouts returns the current timeouts.
+func (c *Cache) Timeouts() Timeouts {
+	return c.timeouts.Load().(Timeouts)
 }
 
 // Lookup returns the backend associated with the given key.  If the
 // cached backend is unhealthy, or the key is not cached, it retrieves a
 // backend from the underlying function.  Lookup returns false if no
 // backend is available.
+//
+// The connection's state is left unchanged; new connections use the
+// Other timeout.
 func (c *Cache) Lookup(key uint64) (*common.Backend, bool) {
-	e, ok := c.table[key]
+	return c.LookupFlow(key, 0, 0)
+}
+
+// LookupFlow is like Lookup, but also updates the connection's state,
+// and so its timeout, from a packet with the given IP protocol and, for
+// TCP, flags.
+func (c *Cache) LookupFlow(key uint64, protocol uint8, flags TCPFlags) (*common.Backend, bool) {
+	s := c.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	timeouts := c.Timeouts()
+	now := time.Now()
+	elem, ok := s.table[key]
 	if ok {
-		if e.backend == nil || time.Now().After(e.expire) {
-			ok = false
-		} else {
-			select {
-			case <-e.backend.Unhealthy:
-				ok = false
-			default:
+		e := elem.Value.(*Entry)
+		if c.live(e, now, true) {
+			old := e.State
+			e.State = e.State.next(protocol, flags)
+			e.Expire = now.Add(timeouts.Timeout(e.State))
+			s.lru.MoveToFront(elem)
+			if e.State != old {
+				c.changed(e)
 			}
+			return e.Backend, true
 		}
+		s.remove(elem)
 	}
+
+	backend, ok := c.miss(key)
 	if !ok {
-		e.backend, ok = c.miss(key)
-		if !ok {
-			delete(c.table, key)
-			return nil, false
+		return nil, false
+	}
+	st := StateOther.next(protocol, flags)
+	e := &Entry{
+		Key:     key,
+		Backend: backend,
+		State:   st,
+		Expire:  now.Add(timeouts.Timeout(st)),
+	}
+	c.insert(s, e, now)
+	c.changed(e)
+	return backend, true
+}
+
+// insert adds a new entry to a shard, evicting the least recently used
+// entry if the shard is full.  s.mutex must be held.
+func (c *Cache) insert(s *shard, e *Entry, now time.Time) {
+	if s.max > 0 && len(s.table) >= s.max {
+		// an expired or unhealthy entry is counted as such
+		back := s.lru.Back()
+		if c.live(back.Value.(*Entry), now, true) {
+			atomic.AddUint64(&c.capacity, 1)
+		}
+		s.remove(back)
+	}
+	s.table[e.Key] = s.lru.PushFront(e)
+}
+
+// OnChange arranges for f to be called with a copy of every entry which
+// Lookup or LookupFlow adds, or whose state they change, for example to
+// share it with other spikes.  Entries added by Insert are not passed
+// to f.  f is called with a lock held, so it must not block or use the
+// cache.
+func (c *Cache) OnChange(f func(Entry)) {
+	c.onChange.Store(f)
+}
+
+func (c *Cache) changed(e *Entry) {
+	if f, ok := c.onChange.Load().(func(Entry)); ok && f != nil {
+		f(*e)
+	}
+}
+
+// Insert adds an entry learned elsewhere, for example from another
+// spike, unless its backend is unhealthy or it has expired.  If the
+// connection is already tracked, its backend and state are kept, but
+// its expiry time is extended to the entry's if that is later.
+func (c *Cache) Insert(e Entry) {
+	s := c.shard(e.Key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if !c.live(&e, now, false) {
+		return
+	}
+	if elem, ok := s.table[e.Key]; ok {
+		cur := elem.Value.(*Entry)
+		if c.live(cur, now, true) {
+			if e.Expire.After(cur.Expire) {
+				cur.Expire = e.Expire
+			}
+			return
+		}
+		s.remove(elem)
+	}
+	c.insert(s, &e, now)
+}
+
+// Entries returns a copy of every entry which has neither expired nor
+// been evicted.
+func (c *Cache) Entries() []Entry {
+	now := time.Now()
+	var entries []Entry
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mutex.Lock()
+		for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+			e := elem.Value.(*Entry)
+			if c.live(e, now, false) {
+				entries = append(entries, *e)
+			}
 		}
+		s.mutex.Unlock()
 	}
-	e.expire = time.Now().Add(c.expiry)
-	c.table[key] = e
+	return entries
+}
+
+// Flows returns the number of connections tracked to the given backend
+// which have neither expired nor been evicted.
+func (c *Cache) Flows(backend *common.Backend) int {
+	now := time.Now()
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mutex.Lock()
+		for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+			e := elem.Value.(*Entry)
+			if e.Backend == backend && c.live(e, now, false) {
+				n++
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return n
+}
+
+// Sweep evicts every expired entry and every entry whose backend is
+// unhealthy, and returns the number evicted.  Each shard is locked
+// only while it is being swept.
+func (c *Cache) Sweep() int {
+	now := time.Now()
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mutex.Lock()
+		for elem := s.lru.Back(); elem != nil; {
+			prev := elem.Prev()
+			if !c.live(elem.Value.(*Entry), now, true) {
+				s.remove(elem)
+				n++
+			}
+			elem = prev
+		}
+		s.mutex.Unlock()
+	}
+	return n
+}
+
+// SweepEvery sweeps the cache every interval in the background.  Close
+// quit to stop sweeping.
+func (c *Cache) SweepEvery(interval time.Duration, quit <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				c.Sweep()
+			}
+		}
+	}()
+}
+
+// Stats returns the number of entries in the cache, including any which
+// have expired but not yet been evicted, and the eviction counters.
+func (c *Cache) Stats() Stats {
+	st := Stats{
+		Expired:   atomic.LoadUint64(&c.expired),
+		Unhealthy: atomic.LoadUint64(&c.unhealthy),
+		Capacity:  atomic.LoadUint64(&c.capacity),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mutex.Lock()
+		st.Entries += len(s.table)
+		s.mutex.Unlock()
+	}
+	return st
+}
+
+// live returns whether the entry is still valid at the given time.  If
+// it is not and count is set, the reason is counted as an eviction.
+func (c *Cache) live(e *Entry, now time.Time, count bool) bool {
+	if now.After(e.Expire) {
+		if count {
+			atomic.AddUint64(&c.expired, 1)
+		}
+		return false
+	}
+	select {
+	case <-e.Backend.Unhealthy:
+		if count {
+			atomic.AddUint64(&c.unhealthy, 1)
+		}
+		return false
+	default:
+		return true
+	}
+}
 
-	return e.backend, true
+// remove removes an entry from the shard.  s.mutex must be held.
+func (s *shard) remove(elem *list.Element) {
+	delete(s.table, elem.Value.(*Entry).Key)
+	s.lru.Remove(elem)
 }
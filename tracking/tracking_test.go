@@ -0,0 +1,224 @@
+package tracking
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/maglev"
+)
+
+func newBackend(ip ...byte) *common.Backend {
+	return &common.Backend{IP: ip, Unhealthy: make(chan struct{})}
+}
+
+func TestLookup(t *testing.T) {
+	a := newBackend(10, 0, 0, 1)
+	b := newBackend(10, 0, 0, 2)
+	current := a
+	misses := 0
+	c := New(func(uint64) (*common.Backend, bool) {
+		misses++
+		return current, current != nil
+	}, time.Hour)
+
+	backend, ok := c.Lookup(1)
+	require.True(t, ok)
+	assert.True(t, backend == a)
+
+	// tracked connections stay put
+	current = b
+	backend, _ = c.Lookup(1)
+	assert.True(t, backend == a, "tracked connection moved")
+	backend, _ = c.Lookup(2)
+	assert.True(t, backend == b)
+	assert.Equal(t, 2, misses)
+	assert.Equal(t, 1, c.Flows(a))
+
+	// until their backend goes down
+	close(a.Unhealthy)
+	backend, _ = c.Lookup(1)
+	assert.True(t, backend == b, "connection to unhealthy backend")
+	assert.Equal(t, 0, c.Flows(a))
+	assert.Equal(t, 2, c.Flows(b))
+
+	current = nil
+	close(b.Unhealthy)
+	_, ok = c.Lookup(1)
+	assert.False(t, ok)
+}
+
+func TestExpiry(t *testing.T) {
+	a := newBackend(10, 0, 0, 1)
+	b := newBackend(10, 0, 0, 2)
+	current := a
+	c := New(func(uint64) (*common.Backend, bool) {
+		return current, true
+	}, 10*time.Millisecond)
+
+	c.Lookup(1)
+	current = b
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, c.Flows(a))
+	backend, _ := c.Lookup(1)
+	assert.True(t, backend == b, "expired connection still tracked")
+}
+
+func TestConcurrent(t *testing.T) {
+	backends := []*common.Backend{
+		newBackend(10, 0, 0, 1),
+		newBackend(10, 0, 0, 2),
+	}
+	var misses int64
+	c := New(func(key uint64) (*common.Backend, bool) {
+		atomic.AddInt64(&misses, 1)
+		return backends[key%2], true
+	}, time.Hour)
+
+	const workers, keys = 8, 1000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := uint64(0); key < keys; key++ {
+				backend, ok := c.Lookup(key << 20)
+				assert.True(t, ok)
+				assert.True(t, backend == backends[(key<<20)%2])
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(keys), misses)
+	assert.Equal(t, keys, c.Flows(backends[0])+c.Flows(backends[1]))
+}
+
+func TestLimit(t *testing.T) {
+	a := newBackend(10, 0, 0, 1)
+	misses := 0
+	c := newSharded(func(uint64) (*common.Backend, bool) {
+		misses++
+		return a, true
+	}, Uniform(time.Hour), 3, 1)
+
+	for key := uint64(1); key <= 3; key++ {
+		c.Lookup(key)
+	}
+	c.Lookup(1) // 2 is now the least recently used
+	c.Lookup(4)
+	assert.Equal(t, Stats{Entries: 3, Capacity: 1}, c.Stats())
+
+	misses = 0
+	c.Lookup(1)
+	c.Lookup(3)
+	c.Lookup(4)
+	assert.Equal(t, 0, misses, "recently used entry evicted")
+	c.Lookup(2)
+	assert.Equal(t, 1, misses, "least recently used entry not evicted")
+}
+
+func TestSweep(t *testing.T) {
+	a := newBackend(10, 0, 0, 1)
+	b := newBackend(10, 0, 0, 2)
+	current := a
+	c := New(func(uint64) (*common.Backend, bool) {
+		return current, true
+	}, 50*time.Millisecond)
+
+	for key := uint64(0); key < 10; key++ {
+		c.Lookup(key << 32)
+	}
+	current = b
+	for key := uint64(10); key < 15; key++ {
+		c.Lookup(key << 32)
+	}
+	close(a.Unhealthy)
+	assert.Equal(t, 10, c.Sweep())
+	assert.Equal(t, Stats{Entries: 5, Unhealthy: 10}, c.Stats())
+
+	quit := make(chan struct{})
+	defer close(quit)
+	c.SweepEvery(10*time.Millisecond, quit)
+	require.Eventually(t, func() bool {
+		return c.Stats().Entries == 0
+	}, 5*time.Second, 10*time.Millisecond, "expired entries not swept")
+	assert.Equal(t, uint64(5), c.Stats().Expired)
+}
+
+// benchmarkLookup looks up a working set of connections in a cache of
+// Maglev lookups from every benchmark goroutine.  Run it with, for
+// example, -cpu 1,2,4,8 to see how throughput scales.
+func benchmarkLookup(b *testing.B, shards int) {
+	mm := maglev.New(maglev.SmallM)
+	for i := byte(1); i <= 10; i++ {
+		mm.Add(newBackend(10, 0, 0, i))
+	}
+	c := newSharded(mm.Lookup, Uniform(time.Hour), 0, shards)
+
+	keys := make([]uint64, 1<<16)
+	r := rand.New(rand.NewSource(1))
+	for i := range keys {
+		keys[i] = r.Uint64()
+		c.Lookup(keys[i])
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Int()
+		for pb.Next() {
+			c.Lookup(keys[i&(len(keys)-1)])
+			i++
+		}
+	})
+}
+
+func BenchmarkLookupSharded(b *testing.B) {
+	benchmarkLookup(b, numShards)
+}
+
+func BenchmarkLookupSingleLock(b *testing.B) {
+	benchmarkLookup(b, 1)
+}
+
+func TestTimeouts(t *testing.T) {
+	a := newBackend(10, 0, 0, 1)
+	b := newBackend(10, 0, 0, 2)
+	current := a
+	c := New(func(uint64) (*common.Backend, bool) {
+		return current, true
+	}, time.Hour)
+	c.SetTimeouts(Timeouts{
+		TCPSyn:         20 * time.Millisecond,
+		TCPEstablished: time.Hour,
+		TCPClosing:     20 * time.Millisecond,
+		UDP:            time.Hour,
+		Other:          time.Hour,
+	})
+
+	// 1 is half-open, 2 is established, 3 was established elsewhere,
+	// 4 is closing after a FIN, 5 is UDP, and 6 was reset
+	c.LookupFlow(1, protocolTCP, TCPSYN)
+	c.LookupFlow(2, protocolTCP, TCPSYN)
+	c.LookupFlow(2, protocolTCP, TCPACK)
+	c.LookupFlow(3, protocolTCP, TCPACK)
+	c.LookupFlow(4, protocolTCP, TCPACK)
+	c.LookupFlow(4, protocolTCP, TCPFIN|TCPACK)
+	c.LookupFlow(4, protocolTCP, TCPACK)
+	c.LookupFlow(5, protocolUDP, 0)
+	c.LookupFlow(6, protocolTCP, TCPRST)
+	current = b
+	time.Sleep(40 * time.Millisecond)
+
+	for key, want := range map[uint64]*common.Backend{
+		1: b, 2: a, 3: a, 4: b, 5: a, 6: b,
+	} {
+		backend, _ := c.Lookup(key)
+		assert.True(t, backend == want, "key %d: wrong backend", key)
+	}
+}
@@ -0,0 +1,560 @@
+// Package tracksync shares connection-tracking entries between spikes
+// over UDP, so that a connection keeps its backend when it is moved to
+// another spike, for example when a spike restarts or a new one joins,
+// even if the set of backends has changed since it started.
+//
+// Each spike sends the entries its tables add or change to its peers as
+// they happen, and every entry it has periodically, so that peers which
+// missed an update or have just started catch up.  A spike which starts
+// syncing a table also asks its peers for their entries immediately.
+// Every datagram is authenticated with a key shared by all spikes, and
+// datagrams which fail authentication or come from addresses which are
+// not peers are ignored.  The expiry times of received entries are
+// capped by the local timeouts.  Full syncs
+// and answers to requests are spread over half the interval rather than
+// sent at once, so as not to overflow peers' receive buffers.
+//
+// A datagram is, in network byte order:
+//
+//	magic   [4]byte "SPKS"
+//	version uint8   2
+//	type    uint8   1 for entries, 2 to request entries
+//	namelen uint8
+//	name    [namelen]byte, the table name
+//	count   uint16, zero for requests
+//	entries [count]entry
+//	mac     [16]byte, the 128-bit siphash of the rest under the key
+//
+// where each entry is
+//
+//	key     uint64, the hashed five-tuple
+//	state   uint8, a tracking.State
+//	ttl     uint32, milliseconds until the entry expires
+//	iplen   uint8, 4 or 16
+//	ip      [iplen]byte, the backend's IP address
+package tracksync
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/tracking"
+)
+
+const (
+	magic   = "SPKS"
+	version = 2
+
+	macLen = 16
+
+	msgEntries = 1
+	msgRequest = 2
+
+	// maxDatagram is the largest datagram sent, chosen to avoid IP
+	// fragmentation on Ethernet.
+	maxDatagram = 1400
+
+	// updateQueue is how many changed entries may wait to be sent.
+	// Further changes are dropped until the next periodic sync.
+	updateQueue = 4096
+
+	// requestQueue is how many requests for entries may wait to be
+	// answered.  Further requests are dropped.
+	requestQueue = 64
+
+	// paceInterval is how often the datagrams of full syncs are sent.
+	paceInterval = 10 * time.Millisecond
+)
+
+var (
+	errMalformed = errors.New("malformed sync datagram")
+	errForged    = errors.New("sync datagram failed authentication")
+)
+
+// A ResolveFunc returns the local backend with the given IP address, or
+// false if there is no such healthy backend.
+type ResolveFunc func(ip []byte) (*common.Backend, bool)
+
+type table struct {
+	cache   *tracking.Cache
+	resolve ResolveFunc
+}
+
+type update struct {
+	name  string
+	table *table
+	entry tracking.Entry
+}
+
+type request struct {
+	name  string
+	table *table
+	from  netip.AddrPort
+}
+
+// A paced datagram is part of a full sync, waiting to be sent.
+type paced struct {
+	name     string
+	table    *table
+	peers    []netip.AddrPort
+	datagram []byte
+}
+
+// A Syncer shares the entries of a set of named connection-tracking
+// tables with the tables of the same names on its peers.
+type Syncer struct {
+	conn     *net.UDPConn
+	key      common.Key
+	interval time.Duration
+	updates  chan update
+	requests chan request
+	quit     chan struct{}
+	done     sync.WaitGroup
+
+	mutex  sync.Mutex
+	peers  map[netip.AddrPort]bool
+	tables map[string]*table
+}
+
+// Listen starts a Syncer listening on the given UDP address, which
+// sends every entry to its peers every interval, authenticating
+// datagrams with key.  It has no peers or tables until they are added.
+func Listen(addr string, interval time.Duration, key common.Key) (*Syncer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Syncer{
+		conn:     conn,
+		key:      key,
+		interval: interval,
+		updates:  make(chan update, updateQueue),
+		requests: make(chan request, requestQueue),
+		quit:     make(chan struct{}),
+		peers:    make(map[netip.AddrPort]bool),
+		tables:   make(map[string]*table),
+	}
+	s.done.Add(2)
+	go s.receive()
+	go s.send()
+	return s, nil
+}
+
+// Addr returns the address the Syncer is listening on.
+func (s *Syncer) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close stops syncing.
+func (s *Syncer) Close() error {
+	close(s.quit)
+	err := s.conn.Close()
+	s.done.Wait()
+	return err
+}
+
+// SetPeers changes the set of peers to the given UDP addresses, and
+// requests the entries of every table from peers which are new.
+func (s *Syncer) SetPeers(peers []string) error {
+	set := make(map[netip.AddrPort]bool)
+	for _, p := range peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return err
+		}
+		set[unmap(addr.AddrPort())] = true
+	}
+
+	s.mutex.Lock()
+	var added []netip.AddrPort
+	for p := range set {
+		if !s.peers[p] {
+			added = append(added, p)
+		}
+	}
+	s.peers = set
+	var names []string
+	for name := range s.tables {
+		names = append(names, name)
+	}
+	s.mutex.Unlock()
+
+	for _, name := range names {
+		s.sendTo(added, encodeRequest(name))
+	}
+	return nil
+}
+
+// AddTable starts syncing a table under the given name, which must be
+// the same on every spike.  Entries received from peers are added to
+// the cache if resolve finds their backend.  It replaces any table
+// already added with the name.
+func (s *Syncer) AddTable(name string, cache *tracking.Cache, resolve ResolveFunc) {
+	s.mutex.Lock()
+	if old, ok := s.tables[name]; ok {
+		old.cache.OnChange(nil)
+	}
+	t := &table{cache: cache, resolve: resolve}
+	s.tables[name] = t
+	peers := s.peerList()
+	s.mutex.Unlock()
+
+	cache.OnChange(func(e tracking.Entry) {
+		select {
+		case s.updates <- update{name, t, e}:
+		default:
+		}
+	})
+	s.sendTo(peers, encodeRequest(name))
+}
+
+// RemoveTable stops syncing the table with the given name.
+func (s *Syncer) RemoveTable(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if t, ok := s.tables[name]; ok {
+		t.cache.OnChange(nil)
+		delete(s.tables, name)
+	}
+}
+
+// current returns whether t is still the table with the given name.
+// s.mutex must be held.
+func (s *Syncer) current(name string, t *table) bool {
+	return s.tables[name] == t
+}
+
+// peerList returns the peers.  s.mutex must be held.
+func (s *Syncer) peerList() []netip.AddrPort {
+	peers := make([]netip.AddrPort, 0, len(s.peers))
+	for p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (s *Syncer) sendTo(peers []netip.AddrPort, datagrams ...[]byte) {
+	for _, d := range datagrams {
+		d = seal(s.key, d)
+		for _, p := range peers {
+			// Lost datagrams are made up for by the periodic sync.
+			s.conn.WriteToUDPAddrPort(d, p)
+		}
+	}
+}
+
+// send sends changed entries as they arrive, and every entry every
+// interval, paced over half the interval.  Entries of tables which have
+// been removed are not sent.
+func (s *Syncer) send() {
+	defer s.done.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	spread := int(s.interval / 2 / paceInterval)
+	if spread < 1 {
+		spread = 1
+	}
+
+	var queue []paced
+	var perTick int // datagrams sent each paceInterval
+	var pacer *time.Ticker
+	var pace <-chan time.Time
+	defer func() {
+		if pacer != nil {
+			pacer.Stop()
+		}
+	}()
+	enqueue := func(name string, t *table, peers []netip.AddrPort,
+		datagrams [][]byte) {
+		for _, d := range datagrams {
+			queue = append(queue, paced{name, t, peers, d})
+		}
+		if n := (len(queue) + spread - 1) / spread; n > perTick {
+			perTick = n
+		}
+		if pacer == nil && len(queue) > 0 {
+			pacer = time.NewTicker(paceInterval)
+			pace = pacer.C
+		}
+	}
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case u := <-s.updates:
+			// batch whatever else is waiting
+			pending := map[*table][]tracking.Entry{u.table: {u.entry}}
+			names := map[*table]string{u.table: u.name}
+		batch:
+			for {
+				select {
+				case u := <-s.updates:
+					pending[u.table] = append(pending[u.table], u.entry)
+					names[u.table] = u.name
+				default:
+					break batch
+				}
+			}
+			s.mutex.Lock()
+			peers := s.peerList()
+			for t := range pending {
+				if !s.current(names[t], t) {
+					delete(pending, t)
+				}
+			}
+			s.mutex.Unlock()
+			now := time.Now()
+			for t, entries := range pending {
+				s.sendTo(peers, encodeEntries(names[t], entries, now)...)
+			}
+		case r := <-s.requests:
+			enqueue(r.name, r.table, []netip.AddrPort{r.from},
+				encodeEntries(r.name, r.table.cache.Entries(), time.Now()))
+		case <-ticker.C:
+			s.mutex.Lock()
+			peers := s.peerList()
+			tables := make(map[string]*table, len(s.tables))
+			for name, t := range s.tables {
+				tables[name] = t
+			}
+			s.mutex.Unlock()
+			// a full sync supersedes whatever is left of the last one
+			queue, perTick = nil, 0
+			for name, t := range tables {
+				enqueue(name, t, peers,
+					encodeEntries(name, t.cache.Entries(), time.Now()))
+			}
+		case <-pace:
+			n := perTick
+			if n > len(queue) {
+				n = len(queue)
+			}
+			batch := queue[:n]
+			queue = queue[n:]
+			s.mutex.Lock()
+			for i, p := range batch {
+				if !s.current(p.name, p.table) {
+					batch[i].peers = nil
+				}
+			}
+			s.mutex.Unlock()
+			for _, p := range batch {
+				s.sendTo(p.peers, p.datagram)
+			}
+			if len(queue) == 0 {
+				queue, perTick = nil, 0
+				pacer.Stop()
+				pacer, pace = nil, nil
+			}
+		}
+	}
+}
+
+// receive handles datagrams from peers until the connection is closed.
+func (s *Syncer) receive() {
+	defer s.done.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+				continue
+			}
+		}
+		from = unmap(from)
+
+		s.mutex.Lock()
+		isPeer := s.peers[from]
+		s.mutex.Unlock()
+		if !isPeer {
+			continue
+		}
+
+		body, err := open(s.key, buf[:n])
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		typ, name, entries, err := decode(body, now)
+		if err != nil {
+			continue
+		}
+		s.mutex.Lock()
+		t, ok := s.tables[name]
+		s.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		switch typ {
+		case msgRequest:
+			select {
+			case s.requests <- request{name, t, from}:
+			default:
+			}
+		case msgEntries:
+			timeouts := t.cache.Timeouts()
+			for _, e := range entries {
+				backend, ok := t.resolve(e.ip)
+				if !ok {
+					continue
+				}
+				// a peer cannot keep an entry longer than this spike would
+				expire := e.expire
+				if limit := now.Add(timeouts.Timeout(e.state)); expire.After(limit) {
+					expire = limit
+				}
+				t.cache.Insert(tracking.Entry{
+					Key:     e.key,
+					Backend: backend,
+					State:   e.state,
+					Expire:  expire,
+				})
+			}
+		}
+	}
+}
+
+// unmap converts IPv4-mapped IPv6 addresses, as reported by dual-stack
+// sockets, to IPv4 addresses, so that peers compare equal.
+func unmap(a netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+}
+
+// A wireEntry is an entry as sent between spikes, identifying its
+// backend by IP address.
+type wireEntry struct {
+	key    uint64
+	state  tracking.State
+	expire time.Time
+	ip     []byte
+}
+
+func appendHeader(b []byte, typ byte, name string) []byte {
+	b = append(b, magic...)
+	b = append(b, version, typ, byte(len(name)))
+	return append(b, name...)
+}
+
+func encodeRequest(name string) []byte {
+	return binary.BigEndian.AppendUint16(appendHeader(nil, msgRequest, name), 0)
+}
+
+// encodeEntries encodes entries into as many datagrams as are needed.
+// Expired entries are skipped.
+func encodeEntries(name string, entries []tracking.Entry, now time.Time) [][]byte {
+	var datagrams [][]byte
+	var b []byte
+	var count int
+	flush := func() {
+		if count > 0 {
+			countOff := 4 + 3 + len(name)
+			binary.BigEndian.PutUint16(b[countOff:], uint16(count))
+			datagrams = append(datagrams, b)
+		}
+		b, count = nil, 0
+	}
+	for _, e := range entries {
+		ttl := e.Expire.Sub(now) / time.Millisecond
+		if ttl <= 0 {
+			continue
+		}
+		if ttl > 1<<32-1 {
+			ttl = 1<<32 - 1
+		}
+		ip := e.Backend.IP
+		if len(b)+8+1+4+1+len(ip)+macLen > maxDatagram || count == 1<<16-1 {
+			flush()
+		}
+		if b == nil {
+			b = appendHeader(make([]byte, 0, maxDatagram), msgEntries, name)
+			b = append(b, 0, 0) // count
+		}
+		b = binary.BigEndian.AppendUint64(b, e.Key)
+		b = append(b, byte(e.State))
+		b = binary.BigEndian.AppendUint32(b, uint32(ttl))
+		b = append(b, byte(len(ip)))
+		b = append(b, ip...)
+		count++
+	}
+	flush()
+	return datagrams
+}
+
+// seal returns a copy of datagram followed by its MAC under key.
+func seal(key common.Key, datagram []byte) []byte {
+	b := make([]byte, len(datagram), len(datagram)+macLen)
+	copy(b, datagram)
+	k0, k1 := key.Hash128(datagram)
+	b = binary.BigEndian.AppendUint64(b, k0)
+	return binary.BigEndian.AppendUint64(b, k1)
+}
+
+// open returns the datagram sealed in b, or an error if its MAC under
+// key is wrong.
+func open(key common.Key, b []byte) ([]byte, error) {
+	if len(b) < macLen {
+		return nil, errMalformed
+	}
+	datagram := b[:len(b)-macLen]
+	if subtle.ConstantTimeCompare(seal(key, datagram)[len(datagram):],
+		b[len(datagram):]) != 1 {
+		return nil, errForged
+	}
+	return datagram, nil
+}
+
+// decode decodes an opened datagram received at time now.
+func decode(b []byte, now time.Time) (byte, string, []wireEntry, error) {
+	if len(b) < 4+3 || !bytes.Equal(b[:4], []byte(magic)) || b[4] != version {
+		return 0, "", nil, errMalformed
+	}
+	typ := b[5]
+	nameLen := int(b[6])
+	b = b[7:]
+	if len(b) < nameLen+2 {
+		return 0, "", nil, errMalformed
+	}
+	name := string(b[:nameLen])
+	count := int(binary.BigEndian.Uint16(b[nameLen:]))
+	b = b[nameLen+2:]
+
+	entries := make([]wireEntry, 0, count)
+	for i := 0; i < count; i++ {
+		if len(b) < 8+1+4+1 {
+			return 0, "", nil, errMalformed
+		}
+		e := wireEntry{
+			key:   binary.BigEndian.Uint64(b),
+			state: tracking.State(b[8]),
+			expire: now.Add(time.Duration(binary.BigEndian.Uint32(b[9:])) *
+				time.Millisecond),
+		}
+		ipLen := int(b[13])
+		b = b[14:]
+		if (ipLen != net.IPv4len && ipLen != net.IPv6len) || len(b) < ipLen {
+			return 0, "", nil, errMalformed
+		}
+		e.ip = append([]byte(nil), b[:ipLen]...)
+		b = b[ipLen:]
+		entries = append(entries, e)
+	}
+	if len(b) != 0 {
+		return 0, "", nil, errMalformed
+	}
+	return typ, name, entries, nil
+}
@@ -0,0 +1,359 @@
+package tracksync
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sipb/spike/common"
+	"github.com/sipb/spike/tracking"
+)
+
+var testKey = common.Key{K0: 1, K1: 2}
+
+func newBackend(ip ...byte) *common.Backend {
+	return &common.Backend{IP: ip, Unhealthy: make(chan struct{})}
+}
+
+func TestEncoding(t *testing.T) {
+	now := time.Now()
+	var entries []tracking.Entry
+	for i := 0; i < 200; i++ {
+		ip := []byte{10, 0, 0, byte(i)}
+		if i%2 == 1 {
+			ip = bytes.Repeat([]byte{byte(i)}, 16)
+		}
+		entries = append(entries, tracking.Entry{
+			Key:     uint64(i) << 40,
+			Backend: newBackend(ip...),
+			State:   tracking.StateTCPEstablished,
+			Expire:  now.Add(time.Duration(i+1) * time.Second),
+		})
+	}
+	// expired entries are not sent
+	entries = append(entries, tracking.Entry{
+		Key:     1,
+		Backend: newBackend(10, 0, 0, 1),
+		Expire:  now.Add(-time.Second),
+	})
+
+	datagrams := encodeEntries("18.0.0.1:80/tcp", entries, now)
+	require.True(t, len(datagrams) > 1, "entries not split")
+	var got []wireEntry
+	for _, d := range datagrams {
+		assert.LessOrEqual(t, len(d), maxDatagram)
+		typ, name, es, err := decode(d, now)
+		require.NoError(t, err)
+		assert.Equal(t, byte(msgEntries), typ)
+		assert.Equal(t, "18.0.0.1:80/tcp", name)
+		got = append(got, es...)
+	}
+	require.Len(t, got, 200)
+	for i, e := range got {
+		assert.Equal(t, entries[i].Key, e.key)
+		assert.Equal(t, entries[i].State, e.state)
+		assert.Equal(t, entries[i].Backend.IP, e.ip)
+		assert.WithinDuration(t, entries[i].Expire, e.expire, time.Millisecond)
+	}
+
+	typ, name, es, err := decode(encodeRequest("default"), now)
+	require.NoError(t, err)
+	assert.Equal(t, byte(msgRequest), typ)
+	assert.Equal(t, "default", name)
+	assert.Empty(t, es)
+
+	d := datagrams[0]
+	for _, bad := range [][]byte{
+		nil,
+		[]byte("XXXX\x01\x01\x00\x00\x00"),
+		d[:len(d)-1],
+		append(append([]byte(nil), d...), 0),
+	} {
+		_, _, _, err := decode(bad, now)
+		assert.Error(t, err)
+	}
+}
+
+// A spike is the state of one in-process spike: its own backends, with
+// the same IPs as every other spike's, and its own tracking table,
+// which chooses backends by key unless the connection is tracked.
+type spike struct {
+	mutex    sync.Mutex
+	backends map[string]*common.Backend
+	cache    *tracking.Cache
+	syncer   *Syncer
+}
+
+func newSpike(t *testing.T) *spike {
+	s := &spike{backends: make(map[string]*common.Backend)}
+	var ips [][]byte
+	for i := byte(1); i <= 4; i++ {
+		b := newBackend(10, 0, 0, i)
+		s.backends[string(b.IP)] = b
+		ips = append(ips, b.IP)
+	}
+	s.cache = tracking.New(func(key uint64) (*common.Backend, bool) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return s.backends[string(ips[key%4])], true
+	}, time.Hour)
+	var err error
+	s.syncer, err = Listen("127.0.0.1:0", 50*time.Millisecond, testKey)
+	require.NoError(t, err)
+	return s
+}
+
+func (s *spike) resolve(ip []byte) (*common.Backend, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b, ok := s.backends[string(ip)]
+	return b, ok
+}
+
+func connect(t *testing.T, spikes ...*spike) {
+	for _, s := range spikes {
+		var peers []string
+		for _, p := range spikes {
+			if p != s {
+				peers = append(peers, p.syncer.Addr().String())
+			}
+		}
+		require.NoError(t, s.syncer.SetPeers(peers))
+	}
+}
+
+// tracked returns the IP of the backend a spike has tracked for key,
+// without tracking it if it is not.
+func (s *spike) tracked(key uint64) []byte {
+	for _, e := range s.cache.Entries() {
+		if e.Key == key {
+			return e.Backend.IP
+		}
+	}
+	return nil
+}
+
+func TestSync(t *testing.T) {
+	a, b, c := newSpike(t), newSpike(t), newSpike(t)
+	for _, s := range []*spike{a, b, c} {
+		defer s.syncer.Close()
+		s.syncer.AddTable("default", s.cache, s.resolve)
+	}
+	connect(t, a, b, c)
+
+	// a connection tracked on a moves to b and c
+	backend, ok := a.cache.Lookup(1)
+	require.True(t, ok)
+	require.Eventually(t, func() bool {
+		return bytes.Equal(b.tracked(1), backend.IP) &&
+			bytes.Equal(c.tracked(1), backend.IP)
+	}, 5*time.Second, 10*time.Millisecond, "entry not synced")
+
+	// and keeps its backend there even though b would choose another
+	got, _ := b.cache.Lookup(1)
+	assert.Equal(t, backend.IP, got.IP)
+	local, _ := b.resolve(backend.IP)
+	assert.True(t, got == local, "synced entry not resolved to local backend")
+
+	// a new spike learns existing connections when it joins
+	d := newSpike(t)
+	defer d.syncer.Close()
+	d.syncer.AddTable("default", d.cache, d.resolve)
+	connect(t, a, b, c, d)
+	require.Eventually(t, func() bool {
+		return bytes.Equal(d.tracked(1), backend.IP)
+	}, 5*time.Second, 10*time.Millisecond, "entry not synced to new spike")
+
+	// entries for backends which are down locally are ignored
+	c.mutex.Lock()
+	down := string([]byte{10, 0, 0, 3}) // key 2's backend
+	close(c.backends[down].Unhealthy)
+	delete(c.backends, down)
+	c.mutex.Unlock()
+	a.cache.Lookup(2)
+	a.cache.Lookup(3)
+	require.Eventually(t, func() bool {
+		return c.tracked(3) != nil
+	}, 5*time.Second, 10*time.Millisecond, "entry not synced")
+	assert.Nil(t, c.tracked(2))
+}
+
+func TestSeal(t *testing.T) {
+	d := encodeRequest("default")
+	sealed := seal(testKey, d)
+	require.Len(t, sealed, len(d)+macLen)
+	body, err := open(testKey, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, d, body)
+
+	_, err = open(common.Key{K0: 1, K1: 3}, sealed)
+	assert.Error(t, err, "wrong key")
+	sealed[0] ^= 1
+	_, err = open(testKey, sealed)
+	assert.Error(t, err, "altered datagram")
+	_, err = open(testKey, sealed[:macLen-1])
+	assert.Error(t, err, "short datagram")
+}
+
+// sendEntries makes a new socket s's only peer, and sends entries for
+// the default table to s from it, sealed under key.
+func sendEntries(t *testing.T, s *spike, key common.Key,
+	entries []tracking.Entry) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, s.syncer.SetPeers([]string{conn.LocalAddr().String()}))
+	to := s.syncer.Addr().(*net.UDPAddr)
+	for _, d := range encodeEntries("default", entries, time.Now()) {
+		_, err := conn.WriteToUDP(seal(key, d), to)
+		require.NoError(t, err)
+	}
+}
+
+func TestForged(t *testing.T) {
+	s := newSpike(t)
+	defer s.syncer.Close()
+	s.syncer.AddTable("default", s.cache, s.resolve)
+
+	entry := tracking.Entry{
+		Key:     1,
+		Backend: newBackend(10, 0, 0, 4),
+		State:   tracking.StateTCPEstablished,
+		Expire:  time.Now().Add(time.Minute),
+	}
+	sendEntries(t, s, common.Key{K0: 1, K1: 3}, []tracking.Entry{entry})
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, s.tracked(1), "forged entry accepted")
+
+	sendEntries(t, s, testKey, []tracking.Entry{entry})
+	require.Eventually(t, func() bool {
+		return s.tracked(1) != nil
+	}, 5*time.Second, 10*time.Millisecond, "authentic entry not accepted")
+}
+
+func TestExpiryCapped(t *testing.T) {
+	s := newSpike(t)
+	defer s.syncer.Close()
+	s.cache.SetTimeouts(tracking.Uniform(time.Minute))
+	s.syncer.AddTable("default", s.cache, s.resolve)
+
+	sendEntries(t, s, testKey, []tracking.Entry{{
+		Key:     1,
+		Backend: newBackend(10, 0, 0, 4),
+		State:   tracking.StateTCPEstablished,
+		Expire:  time.Now().Add(40 * 24 * time.Hour),
+	}})
+	var expire time.Time
+	require.Eventually(t, func() bool {
+		for _, e := range s.cache.Entries() {
+			if e.Key == 1 {
+				expire = e.Expire
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond, "entry not accepted")
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expire, 5*time.Second)
+}
+
+func TestNotPeer(t *testing.T) {
+	a, b := newSpike(t), newSpike(t)
+	defer a.syncer.Close()
+	defer b.syncer.Close()
+	a.syncer.AddTable("default", a.cache, a.resolve)
+	b.syncer.AddTable("default", b.cache, b.resolve)
+	// only a knows about b
+	require.NoError(t, a.syncer.SetPeers([]string{b.syncer.Addr().String()}))
+	require.NoError(t, b.syncer.SetPeers(nil))
+
+	a.cache.Lookup(1)
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, b.tracked(1), "entry accepted from a non-peer")
+}
+
+// fullSync starts a spike syncing n tracked entries every second to a
+// bare UDP socket, and returns both.
+func fullSync(t *testing.T, n int) (*spike, *net.UDPConn) {
+	s := newSpike(t)
+	s.syncer.Close()
+	var err error
+	s.syncer, err = Listen("127.0.0.1:0", time.Second, testKey)
+	require.NoError(t, err)
+	for key := uint64(0); key < uint64(n); key++ {
+		s.cache.Lookup(key)
+	}
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	require.NoError(t, s.syncer.SetPeers([]string{peer.LocalAddr().String()}))
+	s.syncer.AddTable("default", s.cache, s.resolve)
+	return s, peer
+}
+
+// receiveEntries returns how many entries of the first full sync peer
+// receives, up to max, and when it received the first and last of them.
+// first is called on receiving the first.
+func receiveEntries(t *testing.T, peer *net.UDPConn, max int,
+	first func()) (int, time.Time, time.Time) {
+	var count int
+	var start, end time.Time
+	buf := make([]byte, 65536)
+	for count < max {
+		// the sync takes half the interval, and the next starts after
+		// the other half
+		timeout := 300 * time.Millisecond
+		if count == 0 {
+			timeout = 2 * time.Second
+		}
+		peer.SetReadDeadline(time.Now().Add(timeout))
+		n, err := peer.Read(buf)
+		if err != nil {
+			return count, start, end
+		}
+		body, err := open(testKey, buf[:n])
+		require.NoError(t, err)
+		typ, _, entries, err := decode(body, time.Now())
+		require.NoError(t, err)
+		if typ != msgEntries {
+			continue
+		}
+		if count == 0 {
+			start = time.Now()
+			if first != nil {
+				first()
+			}
+		}
+		count += len(entries)
+		end = time.Now()
+	}
+	return count, start, end
+}
+
+func TestPacing(t *testing.T) {
+	const n = 20000
+	s, peer := fullSync(t, n)
+	defer s.syncer.Close()
+	defer peer.Close()
+
+	count, start, end := receiveEntries(t, peer, n, nil)
+	assert.Equal(t, n, count, "full sync incomplete")
+	// the sync is spread over half the interval
+	assert.Greater(t, end.Sub(start), 200*time.Millisecond,
+		"full sync was not paced")
+}
+
+func TestRemoveTableDuringSync(t *testing.T) {
+	const n = 20000
+	s, peer := fullSync(t, n)
+	defer s.syncer.Close()
+	defer peer.Close()
+
+	count, _, _ := receiveEntries(t, peer, n, func() {
+		s.syncer.RemoveTable("default")
+	})
+	assert.Less(t, count, n, "removed table still synced")
+}